@@ -3,18 +3,48 @@
 // ==========================
 package main
 
-import "sort"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+)
 
 func NewServiceConfigStore() *ServiceConfigStore {
 	return &ServiceConfigStore{
 		profiles: make(map[string]ServiceProfile),
+		builtin:  make(map[string]ServiceProfile),
+		dropIns:  make(map[string]ServiceProfile),
+		user:     make(map[string]ServiceProfile),
 	}
 }
 
-func (s *ServiceConfigStore) Add(p ServiceProfile) {
+// Add validates and stores a runtime profile, persisting it when the store
+// is backed by a file.
+func (s *ServiceConfigStore) Add(p ServiceProfile) error {
+	if p.SchemaVersion == 0 {
+		p.SchemaVersion = ProfileSchemaVersion
+	}
+	if err := ValidateProfile(p); err != nil {
+		return err
+	}
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.profiles[p.Name] = p
+	s.user[p.Name] = p
+	s.skipped = slices.DeleteFunc(s.skipped, func(sp skippedProfile) bool {
+		return sp.name == p.Name
+	})
+	s.rebuild()
+	err := s.save()
+	s.mu.Unlock()
+
+	s.changed()
+	return err
 }
 
 func (s *ServiceConfigStore) Get(name string) (ServiceProfile, bool) {
@@ -59,3 +89,181 @@ func (s *ServiceConfigStore) ListRecommended() []ServiceProfile {
 
 	return out
 }
+
+// --------------------------
+// Layers
+// --------------------------
+
+func (s *ServiceConfigStore) SetBuiltin(profiles []ServiceProfile) {
+	s.mu.Lock()
+	s.builtin = byName(profiles)
+	s.rebuild()
+	s.mu.Unlock()
+
+	s.changed()
+}
+
+// SetDropIns replaces every profile that came from profiles.d.
+func (s *ServiceConfigStore) SetDropIns(profiles []ServiceProfile) {
+	s.mu.Lock()
+	s.dropIns = byName(profiles)
+	s.rebuild()
+	s.mu.Unlock()
+
+	s.changed()
+}
+
+// OnChange registers fn to run after any layer changes.
+func (s *ServiceConfigStore) OnChange(fn func()) {
+	s.mu.Lock()
+	s.onChange = fn
+	s.mu.Unlock()
+}
+
+func (s *ServiceConfigStore) changed() {
+	s.mu.RLock()
+	fn := s.onChange
+	s.mu.RUnlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// rebuild recomputes the merged view; callers hold s.mu.
+func (s *ServiceConfigStore) rebuild() {
+	merged := make(map[string]ServiceProfile, len(s.builtin)+len(s.dropIns)+len(s.user))
+	for _, layer := range []map[string]ServiceProfile{s.builtin, s.dropIns, s.user} {
+		for name, p := range layer {
+			merged[name] = p
+		}
+	}
+	s.profiles = merged
+}
+
+func byName(profiles []ServiceProfile) map[string]ServiceProfile {
+	out := make(map[string]ServiceProfile, len(profiles))
+	for _, p := range profiles {
+		out[p.Name] = p
+	}
+	return out
+}
+
+// --------------------------
+// Persistence
+// --------------------------
+
+// skippedProfile is a saved entry that no longer decodes, kept verbatim so
+// saving the runtime layer doesn't lose it.
+type skippedProfile struct {
+	name string
+	raw  json.RawMessage
+}
+
+// Persist loads runtime profiles from path, if it exists, and saves every
+// later Add there. Entries that don't decode are skipped and reported but
+// written back unchanged; a file that isn't a JSON array is copied to
+// path.bak before it is replaced.
+func (s *ServiceConfigStore) Persist(path string) error {
+	s.mu.Lock()
+	s.path = path
+	s.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	var raws []json.RawMessage
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &raws); err != nil {
+			if bakErr := writeFileAtomic(path+".bak", data, 0o600); bakErr != nil {
+				return fmt.Errorf("%s: %w (backup failed: %v)", path, err, bakErr)
+			}
+			return fmt.Errorf("%s: %w (kept as %s.bak)", path, err, path)
+		}
+	}
+
+	var profiles []ServiceProfile
+	var skipped []skippedProfile
+	var errs []error
+	for i, raw := range raws {
+		var doc map[string]any
+		err := json.Unmarshal(raw, &doc)
+		name, _ := doc["name"].(string)
+		var p ServiceProfile
+		if err == nil {
+			p, err = DecodeProfile(doc)
+		}
+		if err != nil {
+			skipped = append(skipped, skippedProfile{name: name, raw: raw})
+			errs = append(errs, fmt.Errorf("%s: profile %d (%q) skipped: %w", path, i, name, err))
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+
+	s.mu.Lock()
+	s.user = byName(profiles)
+	s.skipped = skipped
+	s.rebuild()
+	s.mu.Unlock()
+
+	s.changed()
+	return errors.Join(errs...)
+}
+
+// save writes the runtime layer atomically; callers hold s.mu.
+func (s *ServiceConfigStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	profiles := make([]ServiceProfile, 0, len(s.user))
+	for _, p := range s.user {
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+
+	out := make([]any, 0, len(profiles)+len(s.skipped))
+	for _, p := range profiles {
+		out = append(out, p)
+	}
+	for _, sp := range s.skipped {
+		out = append(out, sp.raw)
+	}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0o600)
+}
+
+// writeFileAtomic replaces path with data without ever leaving a partial
+// file behind.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
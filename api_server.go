@@ -0,0 +1,142 @@
+// ==========================
+// api_server.go
+// ==========================
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	apiShutdownTimeout = 5 * time.Second
+	apiTokenFileName   = "api.token"
+)
+
+// StartAPI serves the Router and WebAPI for node on one listener at addr.
+// Call it after InitP2P so the router shares the node's host.
+func StartAPI(node *ServiceNode, addr string) (*WebAPI, *http.Server, error) {
+	router, err := NewRouter(node.ctx, node)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token, err := LoadOrCreateAPIToken(node.cfg.Dir)
+	if err != nil {
+		router.Close()
+		return nil, nil, err
+	}
+
+	api := NewWebAPI(router, node)
+	mux := http.NewServeMux()
+	api.Register(mux)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		router.Close()
+		return nil, nil, err
+	}
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           apiGuard(token, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Println("API server stopped:", err)
+		}
+	}()
+
+	return api, srv, nil
+}
+
+// StopAPI drains in-flight requests, then detaches the router from the
+// node's host.
+func StopAPI(api *WebAPI, srv *http.Server) {
+	if srv == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+	}
+	api.router.Close()
+}
+
+// --------------------------
+// Access control
+// --------------------------
+
+// LoadOrCreateAPIToken returns the per-install API token kept in dir,
+// creating it owner-only on first use. Every API request must carry it,
+// so only local users who can read the file can drive the node.
+func LoadOrCreateAPIToken(dir string) (string, error) {
+	path := filepath.Join(dir, apiTokenFileName)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	if err := writeFileAtomic(path, []byte(token+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// apiGuard keeps web pages away from the API: requests need the bearer
+// token, browser cross-origin requests are refused outright, and API
+// bodies must be JSON so a "simple" text/plain form post can't get
+// through. Proxied requests carry whatever body the service expects.
+func apiGuard(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+			http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+			return
+		}
+
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "missing or wrong API token", http.StatusUnauthorized)
+			return
+		}
+
+		if r.Body != nil && r.Body != http.NoBody && !isProxyPath(r.URL.Path) {
+			mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mt != "application/json" {
+				http.Error(w, "body must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isProxyPath(path string) bool {
+	return path == "/v1/translate" || strings.HasPrefix(path, "/v1/proxy/")
+}
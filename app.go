@@ -5,6 +5,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os/exec"
@@ -20,9 +21,9 @@ type App struct {
 	server *http.Server
 }
 
-func NewApp() *App {
+func NewApp(node *ServiceNode) *App {
 	return &App{
-		node: NewServiceNode(),
+		node: node,
 	}
 }
 
@@ -30,6 +31,21 @@ func (a *App) Startup(ctx context.Context) {
 	a.ctx = ctx
 	a.node.SetWailsContext(ctx)
 	_ = a.node.InitP2P()
+	a.node.WatchContainerEvents()
+	a.node.StartMetricsSampler()
+	a.node.StartLogFollowers()
+	a.node.WatchProfileDir()
+
+	// The desktop app serves the same API as the daemon, so scripts can
+	// drive it too. Another node may already hold the port.
+	if addr := a.node.cfg.Listen; addr != "" {
+		api, srv, err := StartAPI(a.node, addr)
+		if err != nil {
+			fmt.Println("API server disabled:", err)
+		} else {
+			a.api, a.server = api, srv
+		}
+	}
 
 	// Bind JS events
 	runtime.EventsOn(ctx, "check-docker-status", func(optionalData ...interface{}) {
@@ -68,12 +84,13 @@ func (a *App) Startup(ctx context.Context) {
 	}()
 }
 
+func (a *App) Shutdown(ctx context.Context) {
+	StopAPI(a.api, a.server)
+	a.node.Close()
+}
+
 func (a *App) GetNodeSnapshot() NodeSnapshot {
-	return NodeSnapshot{
-		Services: a.node.ListServices(),
-		Peers:    a.node.GetPeers(),
-		Stats:    a.node.stats.Snapshot(),
-	}
+	return a.node.Snapshot()
 }
 
 // Greet example function
@@ -94,6 +111,176 @@ func (a *App) ListServices() []Service {
 	return a.node.ListServices()
 }
 
+// GetServiceMetrics returns resource samples for a service covering the
+// last windowSeconds (everything buffered when 0).
+func (a *App) GetServiceMetrics(serviceID string, windowSeconds int) []MetricSample {
+	return a.node.ServiceMetrics(serviceID, time.Duration(windowSeconds)*time.Second)
+}
+
+// TailServiceLogs returns the newest n log lines for a service.
+func (a *App) TailServiceLogs(serviceID string, n int) []LogLine {
+	lines, _ := a.node.TailLogs(serviceID, n)
+	return lines
+}
+
+// SearchServiceLogs returns up to limit retained lines containing query.
+func (a *App) SearchServiceLogs(serviceID, query string, limit int) []LogLine {
+	lines, _ := a.node.SearchLogs(serviceID, query, limit)
+	return lines
+}
+
+// ExportServiceLogs asks where to save a service's log history and writes
+// it there as plain text.
+func (a *App) ExportServiceLogs(serviceID string) string {
+	path, err := runtime.SaveFileDialog(a.ctx, runtime.SaveDialogOptions{
+		Title:           "Export logs",
+		DefaultFilename: serviceID + ".log",
+	})
+	if err != nil {
+		return err.Error()
+	}
+	if path == "" {
+		return "export cancelled"
+	}
+
+	if err := a.node.ExportLogs(serviceID, path); err != nil {
+		return err.Error()
+	}
+	return "logs exported to " + path
+}
+
+// GetPeerID returns the peer ID this node is running as.
+func (a *App) GetPeerID() string {
+	id, err := a.node.PeerID()
+	if err != nil {
+		return ""
+	}
+	return id.String()
+}
+
+// GetPendingPeerID returns the peer ID a rotated or imported identity will
+// have after a restart, or "" when there is none.
+func (a *App) GetPendingPeerID() string {
+	id, ok, err := a.node.PendingPeerID()
+	if err != nil || !ok {
+		return ""
+	}
+	return id.String()
+}
+
+func (a *App) ExportIdentity() string {
+	path, err := runtime.SaveFileDialog(a.ctx, runtime.SaveDialogOptions{
+		Title:           "Export node identity",
+		DefaultFilename: identityFileName,
+	})
+	if err != nil {
+		return err.Error()
+	}
+	if path == "" {
+		return "export cancelled"
+	}
+
+	if err := a.node.ExportIdentity(path); err != nil {
+		return err.Error()
+	}
+	return "identity exported to " + path + "; keep it private"
+}
+
+func (a *App) ImportIdentity() string {
+	path, err := runtime.OpenFileDialog(a.ctx, runtime.OpenDialogOptions{
+		Title: "Import node identity",
+	})
+	if err != nil {
+		return err.Error()
+	}
+	if path == "" {
+		return "import cancelled"
+	}
+
+	id, err := a.node.ImportIdentity(path)
+	if err != nil {
+		return err.Error()
+	}
+	return "imported identity " + id.String() + "; restart undocked to use it"
+}
+
+func (a *App) RotateIdentity() string {
+	id, err := a.node.RotateIdentity()
+	if err != nil {
+		return err.Error()
+	}
+	return "new identity " + id.String() + "; restart undocked to use it"
+}
+
+// CreateGroup returns the new group's invite token.
+func (a *App) CreateGroup(name string) string {
+	invite, err := a.node.CreateGroup(name)
+	if err != nil {
+		return err.Error()
+	}
+	return invite
+}
+
+func (a *App) GroupInvite(name string) string {
+	invite, err := a.node.GroupInvite(name)
+	if err != nil {
+		return err.Error()
+	}
+	return invite
+}
+
+func (a *App) JoinGroup(invite string) string {
+	g, err := a.node.JoinGroup(invite)
+	if err != nil {
+		return err.Error()
+	}
+	return "joined " + g.Name
+}
+
+func (a *App) LeaveGroup(name string) string {
+	if err := a.node.LeaveGroup(name); err != nil {
+		return err.Error()
+	}
+	return "left " + name
+}
+
+func (a *App) ListGroups() []GroupInfo {
+	return a.node.ListGroups()
+}
+
+func (a *App) ListVolumes() []VolumeInfo {
+	vols, _ := a.node.ListVolumes()
+	return vols
+}
+
+func (a *App) InspectVolume(name string) VolumeInfo {
+	v, _ := a.node.InspectVolume(name)
+	return v
+}
+
+// DeleteVolume permanently removes a volume and the data in it.
+func (a *App) DeleteVolume(name string) string {
+	if err := a.node.DeleteVolume(name); err != nil {
+		return err.Error()
+	}
+	return "volume deleted"
+}
+
+// ConfigureService validates and saves a profile. It returns the
+// validation problems, if any; an empty list means it was saved.
+func (a *App) ConfigureService(profile ServiceProfile) []FieldError {
+	err := a.node.config.Add(profile)
+
+	var ve *ValidationError
+	switch {
+	case errors.As(err, &ve):
+		return ve.Errors
+	case err != nil:
+		return []FieldError{{Field: "", Message: err.Error()}}
+	}
+	return []FieldError{}
+}
+
 func (a *App) ListRecommendedServices() []ServiceProfile {
 	return a.node.ListRecommendedServices()
 }
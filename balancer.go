@@ -0,0 +1,247 @@
+// ==========================
+// balancer.go
+// ==========================
+package main
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Load-balancing strategies for LoadBalancing.Strategy.
+const (
+	StrategyLeastLoaded    = "least-loaded"
+	StrategyRoundRobin     = "round-robin"
+	StrategyWeighted       = "weighted"
+	StrategyPowerOfTwo     = "p2c"
+	StrategyLatencyEWMA    = "latency-ewma"
+	StrategyConsistentHash = "consistent-hash"
+)
+
+// Hash keys for StrategyConsistentHash. A key of "header:<Name>" hashes on
+// that request header instead.
+const (
+	HashKeyClient = "client"
+	HashKeyPath   = "path"
+)
+
+const (
+	ewmaAlpha = 0.3
+
+	// errorLatency is what a failed request counts as for latency-ewma.
+	errorLatency = 5 * time.Second
+)
+
+// LoadBalancing configures how the router spreads a profile's requests
+// over the peers running it. Weight and Capacity are announced by the
+// hosting node: Weight is used by the weighted strategy and defaults to 1;
+// Capacity is how many concurrent requests one instance takes, 0 meaning
+// unlimited.
+type LoadBalancing struct {
+	Strategy string `json:"strategy,omitempty"`
+	HashKey  string `json:"hashKey,omitempty"`
+	Weight   int    `json:"weight,omitempty"`
+	Capacity int    `json:"capacity,omitempty"`
+}
+
+func (lb LoadBalancing) strategy() string {
+	if lb.Strategy == "" {
+		return StrategyLeastLoaded
+	}
+	return lb.Strategy
+}
+
+func (lb LoadBalancing) weight() int {
+	if lb.Weight > 0 {
+		return lb.Weight
+	}
+	return 1
+}
+
+// requestKey extracts what consistent hashing keys req on.
+func (lb LoadBalancing) requestKey(req *http.Request) string {
+	switch key := lb.HashKey; {
+	case key == HashKeyPath:
+		return req.URL.Path
+	case strings.HasPrefix(key, "header:"):
+		return req.Header.Get(strings.TrimPrefix(key, "header:"))
+	default:
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return req.RemoteAddr
+		}
+		return host
+	}
+}
+
+func validStrategy(s string) bool {
+	switch s {
+	case "", StrategyLeastLoaded, StrategyRoundRobin, StrategyWeighted,
+		StrategyPowerOfTwo, StrategyLatencyEWMA, StrategyConsistentHash:
+		return true
+	}
+	return false
+}
+
+// Balancer picks one of a profile's endpoints for a request. endpoints is
+// never empty and is sorted by peer and service ID.
+type Balancer interface {
+	Pick(endpoints []ServiceEndpoint, key string) ServiceEndpoint
+}
+
+// latencyObserver is implemented by balancers that learn from request
+// outcomes.
+type latencyObserver interface {
+	Observe(e ServiceEndpoint, d time.Duration, err error)
+}
+
+func NewBalancer(strategy string) Balancer {
+	switch strategy {
+	case StrategyRoundRobin:
+		return &roundRobin{}
+	case StrategyWeighted:
+		return weighted{}
+	case StrategyPowerOfTwo:
+		return powerOfTwo{}
+	case StrategyLatencyEWMA:
+		return &latencyEWMA{ewma: map[string]float64{}}
+	case StrategyConsistentHash:
+		return consistentHash{}
+	default:
+		return leastLoaded{}
+	}
+}
+
+func endpointKey(e ServiceEndpoint) string {
+	return e.PeerID.String() + "/" + e.ServiceID
+}
+
+// --------------------------
+// Strategies
+// --------------------------
+
+type leastLoaded struct{}
+
+func (leastLoaded) Pick(endpoints []ServiceEndpoint, _ string) ServiceEndpoint {
+	min := endpoints[0]
+	for _, e := range endpoints[1:] {
+		if e.Load < min.Load {
+			min = e
+		}
+	}
+	return min
+}
+
+type roundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (rr *roundRobin) Pick(endpoints []ServiceEndpoint, _ string) ServiceEndpoint {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	e := endpoints[rr.next%len(endpoints)]
+	rr.next++
+	return e
+}
+
+// weighted picks at random in proportion to each endpoint's Weight.
+type weighted struct{}
+
+func (weighted) Pick(endpoints []ServiceEndpoint, _ string) ServiceEndpoint {
+	total := 0
+	for _, e := range endpoints {
+		total += max(e.Weight, 1)
+	}
+	n := rand.IntN(total)
+	for _, e := range endpoints {
+		n -= max(e.Weight, 1)
+		if n < 0 {
+			return e
+		}
+	}
+	return endpoints[len(endpoints)-1]
+}
+
+// powerOfTwo samples two endpoints and keeps the less loaded one, which
+// avoids herding on a single stale "least loaded" endpoint.
+type powerOfTwo struct{}
+
+func (powerOfTwo) Pick(endpoints []ServiceEndpoint, _ string) ServiceEndpoint {
+	if len(endpoints) == 1 {
+		return endpoints[0]
+	}
+	i := rand.IntN(len(endpoints))
+	j := rand.IntN(len(endpoints) - 1)
+	if j >= i {
+		j++
+	}
+	if endpoints[j].Load < endpoints[i].Load {
+		return endpoints[j]
+	}
+	return endpoints[i]
+}
+
+// latencyEWMA prefers the endpoint with the lowest smoothed response
+// time. Endpoints without observations score zero so they get tried.
+type latencyEWMA struct {
+	mu   sync.Mutex
+	ewma map[string]float64 // seconds
+}
+
+func (l *latencyEWMA) Pick(endpoints []ServiceEndpoint, _ string) ServiceEndpoint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	best := endpoints[0]
+	bestScore := l.ewma[endpointKey(best)]
+	for _, e := range endpoints[1:] {
+		if s := l.ewma[endpointKey(e)]; s < bestScore {
+			best, bestScore = e, s
+		}
+	}
+	return best
+}
+
+func (l *latencyEWMA) Observe(e ServiceEndpoint, d time.Duration, err error) {
+	if err != nil {
+		d = max(d, errorLatency)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k := endpointKey(e)
+	if prev, ok := l.ewma[k]; ok {
+		l.ewma[k] = ewmaAlpha*d.Seconds() + (1-ewmaAlpha)*prev
+	} else {
+		l.ewma[k] = d.Seconds()
+	}
+}
+
+// consistentHash uses rendezvous hashing: every endpoint scores the key
+// and the highest score wins, so a key keeps its endpoint while that
+// endpoint stays up, and only its keys move when it goes away.
+type consistentHash struct{}
+
+func (consistentHash) Pick(endpoints []ServiceEndpoint, key string) ServiceEndpoint {
+	var (
+		best      ServiceEndpoint
+		bestScore uint64
+	)
+	for i, e := range endpoints {
+		h := fnv.New64a()
+		h.Write([]byte(endpointKey(e)))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if s := h.Sum64(); i == 0 || s > bestScore {
+			best, bestScore = e, s
+		}
+	}
+	return best
+}
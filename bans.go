@@ -3,7 +3,10 @@
 // ==========================
 package main
 
-import "sync"
+import (
+	"sort"
+	"sync"
+)
 
 type BanList struct {
 	mu     sync.RWMutex
@@ -26,3 +29,21 @@ func (b *BanList) IsBanned(addr string) bool {
 	b.mu.RUnlock()
 	return ok
 }
+
+func (b *BanList) Unban(addr string) {
+	b.mu.Lock()
+	delete(b.banned, addr)
+	b.mu.Unlock()
+}
+
+// List returns the banned addresses in sorted order.
+func (b *BanList) List() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	out := make([]string, 0, len(b.banned))
+	for addr := range b.banned {
+		out = append(out, addr)
+	}
+	sort.Strings(out)
+	return out
+}
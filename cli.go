@@ -0,0 +1,503 @@
+// ==========================
+// cli.go
+// ==========================
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// cliCommands are the client subcommands of the undocked binary. They talk
+// to a running node's Web API, so they work the same against the desktop
+// app and the daemon.
+var cliCommands = map[string]func(*cliContext, []string) error{
+	"services": cliServices,
+	"profiles": cliProfiles,
+	"start":    cliStart,
+	"stop":     cliStop,
+	"logs":     cliLogs,
+	"peers":    cliPeers,
+	"stats":    cliStats,
+	"ban":      cliBan,
+	"unban":    cliUnban,
+	"bans":     cliBans,
+	"groups":   cliGroups,
+	"group":    cliGroup,
+}
+
+const cliUsage = `usage: undocked <command> [flags] [args]
+
+Commands:
+  daemon                             run a node without the desktop window
+  services                           list services on the node
+  profiles                           list service profiles
+  start <profile> --port N [--env K=V ...]
+                                     start an instance of a profile
+  stop <instance>                    stop an instance
+  logs <service> [-n N] [-f]         show (and follow) a service's logs
+  peers                              list known peers
+  stats                              show per-service router stats
+  ban <addr> / unban <addr>          ban or unban an address
+  bans                               list banned addresses
+  groups                             list private groups
+  group create <name>                create a group and print its invite
+  group invite <name>                print a group's invite
+  group join <invite>                join a group from an invite
+  group leave <name>                 leave a group
+
+Every client command accepts --api URL (default $UNDOCKED_API or
+http://127.0.0.1:8787), --token (default $UNDOCKED_API_TOKEN or the
+node's api.token in the config directory) and --json.
+`
+
+type cliContext struct {
+	api   string
+	token string
+	json  bool
+	out   io.Writer
+	fs    *flag.FlagSet
+}
+
+// runCLI runs a client subcommand and returns the process exit code.
+func runCLI(name string, args []string) int {
+	cmd, ok := cliCommands[name]
+	if !ok {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+
+	api := os.Getenv("UNDOCKED_API")
+	if api == "" {
+		api = "http://" + defaultListenAddr
+	}
+
+	c := &cliContext{out: os.Stdout, fs: flag.NewFlagSet(name, flag.ExitOnError)}
+	c.fs.StringVar(&c.api, "api", api, "base URL of the node's Web API")
+	c.fs.StringVar(&c.token, "token", os.Getenv("UNDOCKED_API_TOKEN"), "API token (default: the node's api.token)")
+	c.fs.BoolVar(&c.json, "json", false, "print JSON instead of a table")
+	c.fs.Usage = func() { fmt.Fprint(os.Stderr, cliUsage) }
+
+	if err := cmd(c, args); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// parse parses flags anywhere among args and returns the positional ones.
+func (c *cliContext) parse(args []string, want int) ([]string, error) {
+	var pos []string
+	for {
+		c.fs.Parse(args)
+		args = c.fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		pos = append(pos, args[0])
+		args = args[1:]
+	}
+	if len(pos) != want {
+		return nil, fmt.Errorf("%s: expected %d argument(s), got %d", c.fs.Name(), want, len(pos))
+	}
+	c.api = strings.TrimSuffix(c.api, "/")
+	if c.token == "" {
+		c.token = localAPIToken()
+	}
+	return pos, nil
+}
+
+// localAPIToken reads the token of a node sharing our config directory.
+func localAPIToken() string {
+	dir, err := ConfigDir()
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(dir, apiTokenFileName))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// --------------------------
+// HTTP
+// --------------------------
+
+var cliHTTP = &http.Client{Timeout: 60 * time.Second}
+
+func (c *cliContext) get(path string, out interface{}) error {
+	return c.do(http.MethodGet, path, nil, out)
+}
+
+func (c *cliContext) post(path string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPost, path, data, out)
+}
+
+func (c *cliContext) do(method, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, c.api+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := cliHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(resp, out)
+}
+
+func decodeResponse(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var ve ValidationError
+		if json.Unmarshal(msg, &ve) == nil && len(ve.Errors) > 0 {
+			return &ve
+		}
+		if s := strings.TrimSpace(string(msg)); s != "" {
+			return errors.New(s)
+		}
+		return errors.New(resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// --------------------------
+// Output
+// --------------------------
+
+// print writes v as indented JSON with --json, otherwise as a table.
+func (c *cliContext) print(v interface{}, header []string, rows [][]string) error {
+	if c.json {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, r := range rows {
+		fmt.Fprintln(tw, strings.Join(r, "\t"))
+	}
+	return tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// --------------------------
+// Commands
+// --------------------------
+
+func cliServices(c *cliContext, args []string) error {
+	if _, err := c.parse(args, 0); err != nil {
+		return err
+	}
+
+	var services []Service
+	if err := c.get("/v1/services", &services); err != nil {
+		return err
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ServiceID < services[j].ServiceID })
+
+	rows := make([][]string, 0, len(services))
+	for _, s := range services {
+		rows = append(rows, []string{
+			s.ServiceID, orDash(s.Profile), s.DockerImage, orDash(s.HostPort),
+			s.Status, orDash(s.Health), strconv.Itoa(s.Restarts),
+		})
+	}
+	return c.print(services, []string{"ID", "PROFILE", "IMAGE", "PORT", "STATUS", "HEALTH", "RESTARTS"}, rows)
+}
+
+func cliProfiles(c *cliContext, args []string) error {
+	if _, err := c.parse(args, 0); err != nil {
+		return err
+	}
+
+	var profiles []ServiceProfile
+	if err := c.get("/v1/services/profiles", &profiles); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(profiles))
+	for _, p := range profiles {
+		rec := ""
+		if p.Recommended {
+			rec = "yes"
+		}
+		rows = append(rows, []string{p.Name, p.Image, strconv.Itoa(p.ContainerPort), orDash(rec)})
+	}
+	return c.print(profiles, []string{"NAME", "IMAGE", "PORT", "RECOMMENDED"}, rows)
+}
+
+// envFlags collects repeated --env KEY=VALUE flags.
+type envFlags map[string]string
+
+func (e envFlags) String() string { return "" }
+
+func (e envFlags) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected KEY=VALUE, got %q", v)
+	}
+	e[k] = val
+	return nil
+}
+
+func cliStart(c *cliContext, args []string) error {
+	env := envFlags{}
+	port := c.fs.Int("port", 0, "host port to publish the service on")
+	c.fs.Var(env, "env", "KEY=VALUE environment override (repeatable)")
+
+	pos, err := c.parse(args, 1)
+	if err != nil {
+		return err
+	}
+	if *port == 0 {
+		return errors.New("start: --port is required")
+	}
+
+	var inst ServiceInstance
+	req := startRequest{ServiceID: pos[0], Port: *port, Env: env}
+	if err := c.post("/v1/services/start", req, &inst); err != nil {
+		return err
+	}
+	return c.print(inst, []string{"INSTANCE", "PROFILE", "ADDR"}, [][]string{{inst.InstanceID, inst.ProfileID, inst.Addr}})
+}
+
+func cliStop(c *cliContext, args []string) error {
+	pos, err := c.parse(args, 1)
+	if err != nil {
+		return err
+	}
+	if err := c.post("/v1/services/stop", stopRequest{InstanceID: pos[0]}, nil); err != nil {
+		return err
+	}
+	if !c.json {
+		fmt.Fprintln(c.out, "stopped", pos[0])
+	}
+	return nil
+}
+
+func cliLogs(c *cliContext, args []string) error {
+	n := c.fs.Int("n", 100, "number of lines to show")
+	follow := c.fs.Bool("f", false, "keep printing new lines")
+
+	pos, err := c.parse(args, 1)
+	if err != nil {
+		return err
+	}
+
+	// Follow pages: a full page means there may be more waiting.
+	const pageSize = 1000
+
+	var since time.Time
+	limit := *n
+	for {
+		q := url.Values{"id": {pos[0]}, "n": {strconv.Itoa(limit)}}
+		if !since.IsZero() {
+			q.Set("since", since.Format(time.RFC3339Nano))
+		}
+
+		var lines []LogLine
+		if err := c.get("/v1/services/logs?"+q.Encode(), &lines); err != nil {
+			return err
+		}
+		for _, l := range lines {
+			if c.json {
+				json.NewEncoder(c.out).Encode(l)
+			} else {
+				fmt.Fprintf(c.out, "%s %s %s\n", l.Time.Format(time.RFC3339), l.Stream, l.Message)
+			}
+			if l.Time.After(since) {
+				since = l.Time
+			}
+		}
+
+		if !*follow {
+			return nil
+		}
+		// After the initial tail, ask for the lines after the last one
+		// seen, oldest first, and only wait once caught up.
+		caughtUp := limit != pageSize || len(lines) < pageSize
+		limit = pageSize
+		if caughtUp {
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func cliPeers(c *cliContext, args []string) error {
+	if _, err := c.parse(args, 0); err != nil {
+		return err
+	}
+
+	var peers []PeerInfo
+	if err := c.get("/v1/peers", &peers); err != nil {
+		return err
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+
+	rows := make([][]string, 0, len(peers))
+	for _, p := range peers {
+		names := make([]string, 0, len(p.Services))
+		for _, s := range p.Services {
+			names = append(names, s.ServiceID)
+		}
+		rows = append(rows, []string{p.ID, strconv.Itoa(len(p.Services)), orDash(strings.Join(names, ",")), p.LastSeen})
+	}
+	return c.print(peers, []string{"PEER", "SERVICES", "NAMES", "LAST SEEN"}, rows)
+}
+
+func cliStats(c *cliContext, args []string) error {
+	if _, err := c.parse(args, 0); err != nil {
+		return err
+	}
+
+	var stats map[string]ServiceStats
+	if err := c.get("/v1/stats", &stats); err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(stats))
+	for id := range stats {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	rows := make([][]string, 0, len(ids))
+	for _, id := range ids {
+		s := stats[id]
+		rows = append(rows, []string{
+			id, strconv.FormatInt(s.Requests, 10), strconv.FormatInt(s.Errors, 10),
+			strconv.FormatInt(s.Bandwidth, 10), s.LastUpdate.Format(time.RFC3339),
+		})
+	}
+	return c.print(stats, []string{"SERVICE", "REQUESTS", "ERRORS", "BYTES", "UPDATED"}, rows)
+}
+
+func cliBan(c *cliContext, args []string) error {
+	return cliSetBan(c, args, "/v1/ban", "banned")
+}
+
+func cliUnban(c *cliContext, args []string) error {
+	return cliSetBan(c, args, "/v1/unban", "unbanned")
+}
+
+func cliSetBan(c *cliContext, args []string, path, done string) error {
+	pos, err := c.parse(args, 1)
+	if err != nil {
+		return err
+	}
+	if err := c.post(path, map[string]string{"addr": pos[0]}, nil); err != nil {
+		return err
+	}
+	if !c.json {
+		fmt.Fprintln(c.out, done, pos[0])
+	}
+	return nil
+}
+
+func cliBans(c *cliContext, args []string) error {
+	if _, err := c.parse(args, 0); err != nil {
+		return err
+	}
+
+	var bans []string
+	if err := c.get("/v1/bans", &bans); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(bans))
+	for _, b := range bans {
+		rows = append(rows, []string{b})
+	}
+	return c.print(bans, []string{"ADDR"}, rows)
+}
+
+func cliGroups(c *cliContext, args []string) error {
+	if _, err := c.parse(args, 0); err != nil {
+		return err
+	}
+
+	var groups []GroupInfo
+	if err := c.get("/v1/groups", &groups); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(groups))
+	for _, g := range groups {
+		rows = append(rows, []string{g.Name, strconv.Itoa(g.Members), g.Topic})
+	}
+	return c.print(groups, []string{"NAME", "MEMBERS", "TOPIC"}, rows)
+}
+
+func cliGroup(c *cliContext, args []string) error {
+	pos, err := c.parse(args, 2)
+	if err != nil {
+		return err
+	}
+
+	var resp groupRequest
+	switch pos[0] {
+	case "create":
+		err = c.post("/v1/groups/create", groupRequest{Name: pos[1]}, &resp)
+	case "invite":
+		err = c.get("/v1/groups/invite?"+url.Values{"name": {pos[1]}}.Encode(), &resp)
+	case "join":
+		err = c.post("/v1/groups/join", groupRequest{Invite: pos[1]}, &resp)
+	case "leave":
+		resp.Name = pos[1]
+		err = c.post("/v1/groups/leave", groupRequest{Name: pos[1]}, nil)
+	default:
+		return fmt.Errorf("group: unknown action %q", pos[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.print(resp, nil, nil)
+	}
+	switch {
+	case resp.Invite != "":
+		fmt.Fprintln(c.out, resp.Invite)
+	case pos[0] == "leave":
+		fmt.Fprintln(c.out, "left", resp.Name)
+	default:
+		fmt.Fprintln(c.out, "joined", resp.Name)
+	}
+	return nil
+}
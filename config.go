@@ -0,0 +1,129 @@
+// ==========================
+// config.go
+// ==========================
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const configFileName = "config.json"
+
+// NodeConfig is the on-disk node configuration, read from config.json in
+// the config directory. Missing fields keep their defaults.
+type NodeConfig struct {
+	// Dir is the config directory the file was loaded from. Logs and other
+	// state are kept beneath it.
+	Dir string `json:"-"`
+
+	// Backend selects the container engine: "docker" (default) or "podman".
+	Backend string `json:"backend"`
+
+	// Listen is the address of the HTTP API. Empty disables it.
+	Listen string `json:"listen"`
+
+	// HeartbeatSec is how often the node re-announces its services.
+	// Peers not heard from for PeerTTLSec are dropped.
+	HeartbeatSec int `json:"heartbeatSec"`
+	PeerTTLSec   int `json:"peerTTLSec"`
+
+	// MDNS finds and connects to undocked nodes on the local network.
+	MDNS bool `json:"mdns"`
+
+	// DHT finds undocked nodes beyond the LAN through a rendezvous on the
+	// undocked DHT, joined via BootstrapPeers (full multiaddrs with
+	// /p2p/<id>).
+	DHT            bool     `json:"dht"`
+	BootstrapPeers []string `json:"bootstrapPeers"`
+
+	// RelayService lets other peers relay their connections through this
+	// node. Off by default; the node always uses relays as a client.
+	RelayService bool `json:"relayService"`
+
+	// LocalOnly keeps the node on the LAN: no DHT, relays or NAT port
+	// mapping.
+	LocalOnly bool `json:"localOnly"`
+}
+
+const (
+	defaultListenAddr   = "127.0.0.1:8787"
+	defaultHeartbeatSec = 30
+	defaultPeerTTLSec   = 90
+)
+
+func DefaultNodeConfig() NodeConfig {
+	return NodeConfig{
+		Backend:      BackendDocker,
+		Listen:       defaultListenAddr,
+		HeartbeatSec: defaultHeartbeatSec,
+		PeerTTLSec:   defaultPeerTTLSec,
+		MDNS:         true,
+	}
+}
+
+func (c NodeConfig) heartbeat() time.Duration {
+	if c.HeartbeatSec > 0 {
+		return time.Duration(c.HeartbeatSec) * time.Second
+	}
+	return defaultHeartbeatSec * time.Second
+}
+
+// peerTTL is never shorter than two heartbeats, so one lost message
+// doesn't drop a peer.
+func (c NodeConfig) peerTTL() time.Duration {
+	ttl := time.Duration(c.PeerTTLSec) * time.Second
+	if c.PeerTTLSec <= 0 {
+		ttl = defaultPeerTTLSec * time.Second
+	}
+	return max(ttl, 2*c.heartbeat())
+}
+
+// ConfigDir is where undocked keeps its state. UNDOCKED_CONFIG_DIR
+// overrides the per-user default.
+func ConfigDir() (string, error) {
+	if dir := os.Getenv("UNDOCKED_CONFIG_DIR"); dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "undocked"), nil
+}
+
+// LoadNodeConfig reads config.json from the config directory. A missing
+// file yields the defaults; UNDOCKED_BACKEND overrides the backend.
+func LoadNodeConfig() (NodeConfig, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return NodeConfig{}, err
+	}
+	return LoadNodeConfigFile(filepath.Join(dir, configFileName))
+}
+
+func LoadNodeConfigFile(path string) (NodeConfig, error) {
+	cfg := DefaultNodeConfig()
+	cfg.Dir = filepath.Dir(path)
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return cfg, err
+	default:
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	if b := os.Getenv("UNDOCKED_BACKEND"); b != "" {
+		cfg.Backend = b
+	}
+
+	return cfg, nil
+}
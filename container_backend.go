@@ -0,0 +1,61 @@
+// ==========================
+// container_backend.go
+// ==========================
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ContainerBackend is everything ServiceNode needs from a container engine.
+// ContainerRuntime implements it for Docker and Podman; the tests use an
+// in-memory FakeBackend.
+type ContainerBackend interface {
+	Name() string
+	Ping(ctx context.Context) error
+
+	ImageExists(ctx context.Context, image string) (bool, error)
+	PullImage(ctx context.Context, image string, logFn func(string)) error
+
+	CreateContainer(ctx context.Context, spec ContainerSpec) (string, error)
+	StartContainer(ctx context.Context, id string) error
+	StopContainer(ctx context.Context, id string, timeout time.Duration) error
+	RemoveContainer(ctx context.Context, id string, force bool) error
+	InspectContainer(ctx context.Context, id string) (ContainerInfo, error)
+	ListContainers(ctx context.Context, labels map[string]string, all bool) ([]ContainerInfo, error)
+	CreateVolume(ctx context.Context, name string, labels map[string]string) (VolumeInfo, error)
+	InspectVolume(ctx context.Context, name string) (VolumeInfo, error)
+	ListVolumes(ctx context.Context, labels map[string]string) ([]VolumeInfo, error)
+	RemoveVolume(ctx context.Context, name string, force bool) error
+
+	ContainerStats(ctx context.Context, id string) (ContainerStatsSample, error)
+	ExecContainer(ctx context.Context, id string, cmd []string) (int, error)
+
+	// FollowLogs blocks, calling fn for every line the container writes
+	// after since, until ctx is done or the container stops.
+	FollowLogs(ctx context.Context, id string, since time.Time, fn func(LogLine)) error
+
+	// WatchEvents blocks, calling fn for every lifecycle event of
+	// containers carrying labels, until ctx is done or the stream fails.
+	WatchEvents(ctx context.Context, labels map[string]string, fn func(ContainerEvent)) error
+}
+
+const (
+	BackendDocker = "docker"
+	BackendPodman = "podman"
+)
+
+// NewContainerBackend returns the backend selected by name. An empty name
+// means Docker.
+func NewContainerBackend(name string) (ContainerBackend, error) {
+	switch name {
+	case "", BackendDocker:
+		return NewDockerRuntime()
+	case BackendPodman:
+		return NewPodmanRuntime()
+	default:
+		return nil, fmt.Errorf("unknown container backend %q", name)
+	}
+}
@@ -0,0 +1,55 @@
+// ==========================
+// container_events.go
+// ==========================
+package main
+
+import (
+	"time"
+)
+
+const maxEventBackoff = 30 * time.Second
+
+// WatchContainerEvents follows lifecycle events for undocked containers so
+// crashes and out-of-band stops show up without waiting for the next
+// StartService or StopService.
+func (sn *ServiceNode) WatchContainerEvents() {
+	go sn.containerEventLoop()
+}
+
+func (sn *ServiceNode) containerEventLoop() {
+	labels := map[string]string{ServiceLabel: "true"}
+	backoff := time.Second
+
+	for {
+		_ = sn.backend.WatchEvents(sn.ctx, labels, func(ev ContainerEvent) {
+			backoff = time.Second
+			sn.handleContainerEvent(ev)
+		})
+
+		// The stream drops when the engine restarts; wait, then resync
+		// whatever we missed before subscribing again.
+		select {
+		case <-sn.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, maxEventBackoff)
+		sn.refreshServices()
+	}
+}
+
+func (sn *ServiceNode) handleContainerEvent(ev ContainerEvent) {
+	switch ev.Action {
+	case "start":
+		sn.followLogs(ev.Name)
+	case "die":
+		sn.superviseExit(ev)
+	case "destroy":
+		sn.releaseLogs(ev.Name)
+	}
+
+	sn.refreshServices()
+	sn.emit("service-event", ev)
+	sn.BroadcastServices()
+}
@@ -0,0 +1,938 @@
+// ==========================
+// container_runtime.go
+// ==========================
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContainerRuntime talks to a Docker Engine compatible API over its unix
+// socket (or DOCKER_HOST) instead of shelling out to the docker binary.
+type ContainerRuntime struct {
+	name   string
+	base   string
+	client *http.Client
+}
+
+var (
+	ErrContainerNotFound = errors.New("container not found")
+	ErrImageNotFound     = errors.New("image not found")
+	ErrVolumeNotFound    = errors.New("volume not found")
+)
+
+// EngineError is a non-2xx response returned by the Engine API.
+type EngineError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *EngineError) Error() string {
+	return fmt.Sprintf("engine api: %d %s", e.StatusCode, e.Message)
+}
+
+// --------------------------
+// Types
+// --------------------------
+
+type PortBinding struct {
+	HostIP        string `json:"hostIP,omitempty"`
+	HostPort      string `json:"hostPort"`
+	ContainerPort string `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+}
+
+// Mount attaches a named volume (Type "volume", Source is the volume name)
+// or a host directory (Type "bind", Source is the host path).
+type Mount struct {
+	Type     string `json:"type"`
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+type ContainerSpec struct {
+	Name   string
+	Image  string
+	Env    map[string]string
+	Cmd    []string
+	Labels map[string]string
+	Ports  []PortBinding
+	Mounts []Mount
+}
+
+type VolumeInfo struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver"`
+	Mountpoint string            `json:"mountpoint"`
+	Labels     map[string]string `json:"labels"`
+	CreatedAt  string            `json:"createdAt"`
+	UsedBy     []string          `json:"usedBy"`
+}
+
+// ContainerEvent is a lifecycle event for a single container. Action is
+// one of start, die, oom or health_status; Health is set for the latter.
+type ContainerEvent struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Action   string            `json:"action"`
+	Health   string            `json:"health,omitempty"`
+	ExitCode int               `json:"exitCode"`
+	Labels   map[string]string `json:"labels"`
+	Time     time.Time         `json:"time"`
+}
+
+// LogLine is one line of container output. Stream is stdout or stderr for
+// container output and system for undocked's own messages (image pulls).
+type LogLine struct {
+	ServiceID string    `json:"serviceID"`
+	Stream    string    `json:"stream"`
+	Time      time.Time `json:"time"`
+	Message   string    `json:"message"`
+}
+
+// ContainerStatsSample holds raw resource counters for one container at one
+// point in time. CPU counters are cumulative nanoseconds; turning them into
+// a percentage needs a previous sample.
+type ContainerStatsSample struct {
+	Time              time.Time
+	CPUUsage          uint64
+	SystemCPUUsage    uint64
+	PreCPUUsage       uint64
+	PreSystemCPUUsage uint64
+	OnlineCPUs        int
+	MemoryUsage       uint64
+	MemoryLimit       uint64
+	NetRxBytes        uint64
+	NetTxBytes        uint64
+	BlockReadBytes    uint64
+	BlockWriteBytes   uint64
+}
+
+type ContainerInfo struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Image     string            `json:"image"`
+	Labels    map[string]string `json:"labels"`
+	State     string            `json:"state"`
+	Running   bool              `json:"running"`
+	ExitCode  int               `json:"exitCode"`
+	Ports     []PortBinding     `json:"ports"`
+	Mounts    []Mount           `json:"mounts"`
+	CreatedAt time.Time         `json:"createdAt"`
+	StartedAt time.Time         `json:"startedAt"`
+}
+
+// HostPort returns the first published host port, if any.
+func (c ContainerInfo) HostPort() string {
+	for _, p := range c.Ports {
+		if p.HostPort != "" {
+			return p.HostPort
+		}
+	}
+	return ""
+}
+
+// --------------------------
+// Construction
+// --------------------------
+
+// NewContainerRuntime builds a runtime for an endpoint such as
+// unix:///var/run/docker.sock or tcp://127.0.0.1:2375.
+func NewContainerRuntime(name, endpoint string) (*ContainerRuntime, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid engine endpoint %q: %w", endpoint, err)
+	}
+
+	tr := &http.Transport{
+		MaxIdleConns:    4,
+		IdleConnTimeout: 30 * time.Second,
+	}
+
+	rt := &ContainerRuntime{
+		name:   name,
+		client: &http.Client{Transport: tr},
+	}
+
+	switch u.Scheme {
+	case "unix":
+		sock := u.Path
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		}
+		rt.base = "http://" + name
+	case "tcp", "http":
+		rt.base = "http://" + u.Host
+	default:
+		return nil, fmt.Errorf("unsupported engine endpoint scheme %q", u.Scheme)
+	}
+
+	return rt, nil
+}
+
+func firstExisting(paths []string) string {
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return paths[0]
+}
+
+func (rt *ContainerRuntime) Name() string {
+	return rt.name
+}
+
+// --------------------------
+// Transport
+// --------------------------
+
+func (rt *ContainerRuntime) do(ctx context.Context, method, path string, query url.Values, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	u := rt.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		var msg struct {
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(data, &msg) != nil || msg.Message == "" {
+			msg.Message = strings.TrimSpace(string(data))
+		}
+		return nil, &EngineError{StatusCode: resp.StatusCode, Message: msg.Message}
+	}
+
+	return resp, nil
+}
+
+func (rt *ContainerRuntime) doJSON(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	resp, err := rt.do(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func isStatus(err error, code int) bool {
+	var ee *EngineError
+	return errors.As(err, &ee) && ee.StatusCode == code
+}
+
+// --------------------------
+// System
+// --------------------------
+
+func (rt *ContainerRuntime) Ping(ctx context.Context) error {
+	return rt.doJSON(ctx, http.MethodGet, "/_ping", nil, nil, nil)
+}
+
+// --------------------------
+// Images
+// --------------------------
+
+func (rt *ContainerRuntime) ImageExists(ctx context.Context, image string) (bool, error) {
+	err := rt.doJSON(ctx, http.MethodGet, "/images/"+image+"/json", nil, nil, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// PullImage pulls image and reports each progress message through logFn.
+func (rt *ContainerRuntime) PullImage(ctx context.Context, image string, logFn func(string)) error {
+	from, tag := splitImageRef(image)
+
+	q := url.Values{}
+	q.Set("fromImage", from)
+	if tag != "" {
+		q.Set("tag", tag)
+	}
+
+	resp, err := rt.do(ctx, http.MethodPost, "/images/create", q, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			ID       string `json:"id"`
+			Status   string `json:"status"`
+			Progress string `json:"progress"`
+			Error    string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if msg.Error != "" {
+			return fmt.Errorf("pull %s: %s", image, msg.Error)
+		}
+
+		if logFn == nil {
+			continue
+		}
+		line := msg.Status
+		if msg.ID != "" {
+			line = msg.ID + ": " + line
+		}
+		if msg.Progress != "" {
+			line += " " + msg.Progress
+		}
+		logFn(line)
+	}
+}
+
+// splitImageRef splits an image reference into repository and tag,
+// defaulting the tag to "latest" so the engine doesn't pull every tag.
+func splitImageRef(image string) (string, string) {
+	if strings.Contains(image, "@") {
+		return image, ""
+	}
+	slash := strings.LastIndex(image, "/")
+	if colon := strings.LastIndex(image, ":"); colon > slash {
+		return image[:colon], image[colon+1:]
+	}
+	return image, "latest"
+}
+
+// --------------------------
+// Containers
+// --------------------------
+
+type engineContainerConfig struct {
+	Image        string              `json:"Image"`
+	Env          []string            `json:"Env,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	HostConfig   engineHostConfig    `json:"HostConfig"`
+}
+
+type engineHostConfig struct {
+	PortBindings map[string][]enginePortBinding `json:"PortBindings,omitempty"`
+	Mounts       []engineMount                  `json:"Mounts,omitempty"`
+}
+
+type engineMount struct {
+	Type     string `json:"Type"`
+	Source   string `json:"Source"`
+	Target   string `json:"Target"`
+	ReadOnly bool   `json:"ReadOnly,omitempty"`
+}
+
+type enginePortBinding struct {
+	HostIP   string `json:"HostIp,omitempty"`
+	HostPort string `json:"HostPort"`
+}
+
+func (rt *ContainerRuntime) CreateContainer(ctx context.Context, spec ContainerSpec) (string, error) {
+	cfg := engineContainerConfig{
+		Image:  spec.Image,
+		Cmd:    spec.Cmd,
+		Labels: spec.Labels,
+	}
+
+	for k, v := range spec.Env {
+		cfg.Env = append(cfg.Env, k+"="+v)
+	}
+
+	if len(spec.Ports) > 0 {
+		cfg.ExposedPorts = map[string]struct{}{}
+		cfg.HostConfig.PortBindings = map[string][]enginePortBinding{}
+		for _, p := range spec.Ports {
+			proto := p.Protocol
+			if proto == "" {
+				proto = "tcp"
+			}
+			key := p.ContainerPort + "/" + proto
+			cfg.ExposedPorts[key] = struct{}{}
+			cfg.HostConfig.PortBindings[key] = append(cfg.HostConfig.PortBindings[key], enginePortBinding{
+				HostIP:   p.HostIP,
+				HostPort: p.HostPort,
+			})
+		}
+	}
+
+	for _, m := range spec.Mounts {
+		cfg.HostConfig.Mounts = append(cfg.HostConfig.Mounts, engineMount{
+			Type:     m.Type,
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		})
+	}
+
+	q := url.Values{}
+	if spec.Name != "" {
+		q.Set("name", spec.Name)
+	}
+
+	var out struct {
+		ID string `json:"Id"`
+	}
+	err := rt.doJSON(ctx, http.MethodPost, "/containers/create", q, cfg, &out)
+	if isStatus(err, http.StatusNotFound) {
+		return "", fmt.Errorf("%w: %s", ErrImageNotFound, spec.Image)
+	}
+	return out.ID, err
+}
+
+func (rt *ContainerRuntime) StartContainer(ctx context.Context, id string) error {
+	err := rt.doJSON(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil, nil)
+	if isStatus(err, http.StatusNotModified) {
+		return nil
+	}
+	return rt.notFound(err)
+}
+
+func (rt *ContainerRuntime) StopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	q := url.Values{}
+	q.Set("t", strconv.Itoa(int(timeout.Seconds())))
+	err := rt.doJSON(ctx, http.MethodPost, "/containers/"+id+"/stop", q, nil, nil)
+	if isStatus(err, http.StatusNotModified) {
+		return nil
+	}
+	return rt.notFound(err)
+}
+
+func (rt *ContainerRuntime) RemoveContainer(ctx context.Context, id string, force bool) error {
+	q := url.Values{}
+	q.Set("force", strconv.FormatBool(force))
+	return rt.notFound(rt.doJSON(ctx, http.MethodDelete, "/containers/"+id, q, nil, nil))
+}
+
+func (rt *ContainerRuntime) InspectContainer(ctx context.Context, id string) (ContainerInfo, error) {
+	var raw struct {
+		ID      string    `json:"Id"`
+		Name    string    `json:"Name"`
+		Created time.Time `json:"Created"`
+		Config  struct {
+			Image  string            `json:"Image"`
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+		State struct {
+			Status    string    `json:"Status"`
+			Running   bool      `json:"Running"`
+			ExitCode  int       `json:"ExitCode"`
+			StartedAt time.Time `json:"StartedAt"`
+		} `json:"State"`
+		NetworkSettings struct {
+			Ports map[string][]enginePortBinding `json:"Ports"`
+		} `json:"NetworkSettings"`
+		Mounts []engineMountPoint `json:"Mounts"`
+	}
+
+	if err := rt.doJSON(ctx, http.MethodGet, "/containers/"+id+"/json", nil, nil, &raw); err != nil {
+		return ContainerInfo{}, rt.notFound(err)
+	}
+
+	info := ContainerInfo{
+		ID:        raw.ID,
+		Name:      strings.TrimPrefix(raw.Name, "/"),
+		Image:     raw.Config.Image,
+		Labels:    raw.Config.Labels,
+		State:     raw.State.Status,
+		Running:   raw.State.Running,
+		ExitCode:  raw.State.ExitCode,
+		CreatedAt: raw.Created,
+		StartedAt: raw.State.StartedAt,
+	}
+
+	for key, bindings := range raw.NetworkSettings.Ports {
+		port, proto, _ := strings.Cut(key, "/")
+		for _, b := range bindings {
+			info.Ports = append(info.Ports, PortBinding{
+				HostIP:        b.HostIP,
+				HostPort:      b.HostPort,
+				ContainerPort: port,
+				Protocol:      proto,
+			})
+		}
+	}
+
+	for _, m := range raw.Mounts {
+		info.Mounts = append(info.Mounts, m.mount())
+	}
+
+	return info, nil
+}
+
+// engineMountPoint is a mount as reported on an existing container.
+type engineMountPoint struct {
+	Type        string `json:"Type"`
+	Name        string `json:"Name"`
+	Source      string `json:"Source"`
+	Destination string `json:"Destination"`
+	RW          bool   `json:"RW"`
+}
+
+func (m engineMountPoint) mount() Mount {
+	src := m.Source
+	if m.Type == "volume" {
+		src = m.Name
+	}
+	return Mount{Type: m.Type, Source: src, Target: m.Destination, ReadOnly: !m.RW}
+}
+
+// ListContainers returns containers carrying every label in labels.
+// Stopped containers are included when all is set.
+func (rt *ContainerRuntime) ListContainers(ctx context.Context, labels map[string]string, all bool) ([]ContainerInfo, error) {
+	q := url.Values{}
+	if all {
+		q.Set("all", "1")
+	}
+	if len(labels) > 0 {
+		filters, _ := json.Marshal(map[string][]string{"label": labelFilters(labels)})
+		q.Set("filters", string(filters))
+	}
+
+	var raw []struct {
+		ID      string            `json:"Id"`
+		Names   []string          `json:"Names"`
+		Image   string            `json:"Image"`
+		Labels  map[string]string `json:"Labels"`
+		State   string            `json:"State"`
+		Created int64             `json:"Created"`
+		Ports   []struct {
+			IP          string `json:"IP"`
+			PrivatePort int    `json:"PrivatePort"`
+			PublicPort  int    `json:"PublicPort"`
+			Type        string `json:"Type"`
+		} `json:"Ports"`
+		Mounts []engineMountPoint `json:"Mounts"`
+	}
+
+	if err := rt.doJSON(ctx, http.MethodGet, "/containers/json", q, nil, &raw); err != nil {
+		return nil, err
+	}
+
+	out := make([]ContainerInfo, 0, len(raw))
+	for _, c := range raw {
+		info := ContainerInfo{
+			ID:        c.ID,
+			Image:     c.Image,
+			Labels:    c.Labels,
+			State:     c.State,
+			Running:   c.State == "running",
+			CreatedAt: time.Unix(c.Created, 0),
+		}
+		if len(c.Names) > 0 {
+			info.Name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		for _, p := range c.Ports {
+			b := PortBinding{
+				HostIP:        p.IP,
+				ContainerPort: strconv.Itoa(p.PrivatePort),
+				Protocol:      p.Type,
+			}
+			if p.PublicPort != 0 {
+				b.HostPort = strconv.Itoa(p.PublicPort)
+			}
+			info.Ports = append(info.Ports, b)
+		}
+		for _, m := range c.Mounts {
+			info.Mounts = append(info.Mounts, m.mount())
+		}
+		out = append(out, info)
+	}
+
+	return out, nil
+}
+
+func labelFilters(labels map[string]string) []string {
+	out := make([]string, 0, len(labels))
+	for k, v := range labels {
+		if v == "" {
+			out = append(out, k)
+		} else {
+			out = append(out, k+"="+v)
+		}
+	}
+	return out
+}
+
+// --------------------------
+// Volumes
+// --------------------------
+
+type engineVolume struct {
+	Name       string            `json:"Name"`
+	Driver     string            `json:"Driver"`
+	Mountpoint string            `json:"Mountpoint"`
+	Labels     map[string]string `json:"Labels"`
+	CreatedAt  string            `json:"CreatedAt"`
+}
+
+func (v engineVolume) info() VolumeInfo {
+	return VolumeInfo{
+		Name:       v.Name,
+		Driver:     v.Driver,
+		Mountpoint: v.Mountpoint,
+		Labels:     v.Labels,
+		CreatedAt:  v.CreatedAt,
+	}
+}
+
+// CreateVolume creates a local named volume. Creating a volume that
+// already exists returns the existing one.
+func (rt *ContainerRuntime) CreateVolume(ctx context.Context, name string, labels map[string]string) (VolumeInfo, error) {
+	var v engineVolume
+	body := map[string]any{"Name": name, "Labels": labels}
+	if err := rt.doJSON(ctx, http.MethodPost, "/volumes/create", nil, body, &v); err != nil {
+		return VolumeInfo{}, err
+	}
+	return v.info(), nil
+}
+
+func (rt *ContainerRuntime) InspectVolume(ctx context.Context, name string) (VolumeInfo, error) {
+	var v engineVolume
+	err := rt.doJSON(ctx, http.MethodGet, "/volumes/"+name, nil, nil, &v)
+	if isStatus(err, http.StatusNotFound) {
+		return VolumeInfo{}, fmt.Errorf("%w: %s", ErrVolumeNotFound, name)
+	}
+	return v.info(), err
+}
+
+func (rt *ContainerRuntime) ListVolumes(ctx context.Context, labels map[string]string) ([]VolumeInfo, error) {
+	q := url.Values{}
+	if len(labels) > 0 {
+		filters, _ := json.Marshal(map[string][]string{"label": labelFilters(labels)})
+		q.Set("filters", string(filters))
+	}
+
+	var raw struct {
+		Volumes []engineVolume `json:"Volumes"`
+	}
+	if err := rt.doJSON(ctx, http.MethodGet, "/volumes", q, nil, &raw); err != nil {
+		return nil, err
+	}
+
+	out := make([]VolumeInfo, 0, len(raw.Volumes))
+	for _, v := range raw.Volumes {
+		out = append(out, v.info())
+	}
+	return out, nil
+}
+
+// RemoveVolume deletes a volume. The engine refuses while a container
+// still uses it unless force is set.
+func (rt *ContainerRuntime) RemoveVolume(ctx context.Context, name string, force bool) error {
+	q := url.Values{}
+	q.Set("force", strconv.FormatBool(force))
+	err := rt.doJSON(ctx, http.MethodDelete, "/volumes/"+name, q, nil, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("%w: %s", ErrVolumeNotFound, name)
+	}
+	return err
+}
+
+// --------------------------
+// Stats
+// --------------------------
+
+// ContainerStats takes a single stats sample without holding the stream
+// open.
+func (rt *ContainerRuntime) ContainerStats(ctx context.Context, id string) (ContainerStatsSample, error) {
+	q := url.Values{}
+	q.Set("stream", "false")
+
+	var raw struct {
+		Read     time.Time `json:"read"`
+		CPUStats struct {
+			CPUUsage struct {
+				TotalUsage uint64 `json:"total_usage"`
+			} `json:"cpu_usage"`
+			SystemCPUUsage uint64 `json:"system_cpu_usage"`
+			OnlineCPUs     int    `json:"online_cpus"`
+		} `json:"cpu_stats"`
+		PreCPUStats struct {
+			CPUUsage struct {
+				TotalUsage uint64 `json:"total_usage"`
+			} `json:"cpu_usage"`
+			SystemCPUUsage uint64 `json:"system_cpu_usage"`
+		} `json:"precpu_stats"`
+		MemoryStats struct {
+			Usage uint64            `json:"usage"`
+			Limit uint64            `json:"limit"`
+			Stats map[string]uint64 `json:"stats"`
+		} `json:"memory_stats"`
+		Networks map[string]struct {
+			RxBytes uint64 `json:"rx_bytes"`
+			TxBytes uint64 `json:"tx_bytes"`
+		} `json:"networks"`
+		BlkioStats struct {
+			IOServiceBytesRecursive []struct {
+				Op    string `json:"op"`
+				Value uint64 `json:"value"`
+			} `json:"io_service_bytes_recursive"`
+		} `json:"blkio_stats"`
+	}
+
+	if err := rt.doJSON(ctx, http.MethodGet, "/containers/"+id+"/stats", q, nil, &raw); err != nil {
+		return ContainerStatsSample{}, rt.notFound(err)
+	}
+
+	sample := ContainerStatsSample{
+		Time:              raw.Read,
+		CPUUsage:          raw.CPUStats.CPUUsage.TotalUsage,
+		SystemCPUUsage:    raw.CPUStats.SystemCPUUsage,
+		PreCPUUsage:       raw.PreCPUStats.CPUUsage.TotalUsage,
+		PreSystemCPUUsage: raw.PreCPUStats.SystemCPUUsage,
+		OnlineCPUs:        raw.CPUStats.OnlineCPUs,
+		MemoryUsage:       raw.MemoryStats.Usage,
+		MemoryLimit:       raw.MemoryStats.Limit,
+	}
+	if sample.Time.IsZero() {
+		sample.Time = time.Now()
+	}
+
+	// Match `docker stats`: page cache isn't counted as used memory.
+	cache := raw.MemoryStats.Stats["inactive_file"]
+	if cache == 0 {
+		cache = raw.MemoryStats.Stats["total_inactive_file"]
+	}
+	if cache < sample.MemoryUsage {
+		sample.MemoryUsage -= cache
+	}
+
+	for _, n := range raw.Networks {
+		sample.NetRxBytes += n.RxBytes
+		sample.NetTxBytes += n.TxBytes
+	}
+
+	for _, e := range raw.BlkioStats.IOServiceBytesRecursive {
+		switch strings.ToLower(e.Op) {
+		case "read":
+			sample.BlockReadBytes += e.Value
+		case "write":
+			sample.BlockWriteBytes += e.Value
+		}
+	}
+
+	return sample, nil
+}
+
+// ExecContainer runs cmd inside a running container, waits for it and
+// returns its exit code.
+func (rt *ContainerRuntime) ExecContainer(ctx context.Context, id string, cmd []string) (int, error) {
+	var created struct {
+		ID string `json:"Id"`
+	}
+	body := map[string]any{"Cmd": cmd, "AttachStdout": true, "AttachStderr": true}
+	if err := rt.doJSON(ctx, http.MethodPost, "/containers/"+id+"/exec", nil, body, &created); err != nil {
+		return -1, rt.notFound(err)
+	}
+
+	// Without Detach the engine holds the response open until the command
+	// exits; the output itself is discarded.
+	start := map[string]any{"Detach": false, "Tty": false}
+	if err := rt.doJSON(ctx, http.MethodPost, "/exec/"+created.ID+"/start", nil, start, nil); err != nil {
+		return -1, err
+	}
+
+	var result struct {
+		ExitCode int  `json:"ExitCode"`
+		Running  bool `json:"Running"`
+	}
+	if err := rt.doJSON(ctx, http.MethodGet, "/exec/"+created.ID+"/json", nil, nil, &result); err != nil {
+		return -1, err
+	}
+	if result.Running {
+		return -1, fmt.Errorf("exec %v still running", cmd)
+	}
+	return result.ExitCode, nil
+}
+
+// --------------------------
+// Logs
+// --------------------------
+
+// FollowLogs streams stdout and stderr lines written after since, calling
+// fn for each, until ctx is done or the container stops.
+func (rt *ContainerRuntime) FollowLogs(ctx context.Context, id string, since time.Time, fn func(LogLine)) error {
+	q := url.Values{}
+	q.Set("follow", "1")
+	q.Set("stdout", "1")
+	q.Set("stderr", "1")
+	q.Set("timestamps", "1")
+	if !since.IsZero() {
+		q.Set("since", strconv.FormatFloat(float64(since.UnixNano())/1e9, 'f', 9, 64))
+	}
+
+	resp, err := rt.do(ctx, http.MethodGet, "/containers/"+id+"/logs", q, nil)
+	if err != nil {
+		return rt.notFound(err)
+	}
+	defer resp.Body.Close()
+
+	return demuxLogs(resp.Body, fn)
+}
+
+// demuxLogs splits the engine's multiplexed log stream: every frame is an
+// 8-byte header (stream type, three zero bytes, big-endian length) followed
+// by the payload. Frames don't always end on a line boundary.
+func demuxLogs(r io.Reader, fn func(LogLine)) error {
+	var header [8]byte
+	pending := map[string][]byte{}
+
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+
+		stream := "stdout"
+		if header[0] == 2 {
+			stream = "stderr"
+		}
+
+		size := uint32(header[4])<<24 | uint32(header[5])<<16 | uint32(header[6])<<8 | uint32(header[7])
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+
+		buf := append(pending[stream], payload...)
+		for {
+			i := bytes.IndexByte(buf, '\n')
+			if i < 0 {
+				break
+			}
+			fn(parseLogLine(stream, string(buf[:i])))
+			buf = buf[i+1:]
+		}
+		pending[stream] = buf
+	}
+}
+
+// parseLogLine splits the RFC3339 timestamp the engine prefixes when
+// timestamps=1.
+func parseLogLine(stream, raw string) LogLine {
+	line := LogLine{Stream: stream, Message: strings.TrimRight(raw, "\r")}
+	if ts, msg, ok := strings.Cut(line.Message, " "); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			line.Time = t
+			line.Message = msg
+		}
+	}
+	if line.Time.IsZero() {
+		line.Time = time.Now()
+	}
+	return line
+}
+
+// --------------------------
+// Events
+// --------------------------
+
+// WatchEvents streams lifecycle events for containers carrying labels until
+// ctx is done or the connection drops, calling fn for each one.
+func (rt *ContainerRuntime) WatchEvents(ctx context.Context, labels map[string]string, fn func(ContainerEvent)) error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "die", "oom", "health_status", "destroy"},
+		"label": labelFilters(labels),
+	})
+
+	q := url.Values{}
+	q.Set("filters", string(filters))
+
+	resp, err := rt.do(ctx, http.MethodGet, "/events", q, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var raw struct {
+			Action string `json:"Action"`
+			Actor  struct {
+				ID         string            `json:"ID"`
+				Attributes map[string]string `json:"Attributes"`
+			} `json:"Actor"`
+			TimeNano int64 `json:"timeNano"`
+		}
+		if err := dec.Decode(&raw); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		ev := ContainerEvent{
+			ID:     raw.Actor.ID,
+			Name:   raw.Actor.Attributes["name"],
+			Action: raw.Action,
+			Labels: raw.Actor.Attributes,
+			Time:   time.Unix(0, raw.TimeNano),
+		}
+		if action, health, ok := strings.Cut(raw.Action, ":"); ok {
+			ev.Action = action
+			ev.Health = strings.TrimSpace(health)
+		}
+		if code, err := strconv.Atoi(raw.Actor.Attributes["exitCode"]); err == nil {
+			ev.ExitCode = code
+		}
+
+		fn(ev)
+	}
+}
+
+func (rt *ContainerRuntime) notFound(err error) error {
+	if isStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, err)
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+// ==========================
+// containers.go
+// ==========================
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const engineTimeout = 10 * time.Second
+
+// Labels put on every container undocked creates. Listing filters on
+// ServiceLabel so unrelated containers are never touched.
+const (
+	ServiceLabel   = "undocked.service"
+	ServiceIDLabel = "undocked.id"
+	ProfileLabel   = "undocked.profile"
+)
+
+func engineCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), engineTimeout)
+}
+
+// --------------------------
+// Status
+// --------------------------
+
+func (sn *ServiceNode) backendRunning() bool {
+	ctx, cancel := engineCtx()
+	defer cancel()
+	return sn.backend.Ping(ctx) == nil
+}
+
+// --------------------------
+// Images
+// --------------------------
+
+// ensureImage pulls image if the backend doesn't have it yet, logging
+// progress against serviceID.
+func (sn *ServiceNode) ensureImage(serviceID, image string) error {
+	ctx, cancel := engineCtx()
+	ok, err := sn.backend.ImageExists(ctx, image)
+	cancel()
+	if err != nil || ok {
+		return err
+	}
+
+	return sn.backend.PullImage(sn.ctx, image, func(s string) {
+		sn.systemLog(serviceID, s)
+	})
+}
+
+// --------------------------
+// Containers
+// --------------------------
+
+func (sn *ServiceNode) containerState(name string) (exists, running bool) {
+	ctx, cancel := engineCtx()
+	defer cancel()
+
+	info, err := sn.backend.InspectContainer(ctx, name)
+	if err != nil {
+		return false, false
+	}
+	return true, info.Running
+}
+
+func (sn *ServiceNode) waitForRunning(name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		_, running := sn.containerState(name)
+		if running {
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("container %s did not start", name)
+}
+
+// runContainer creates and starts a container labelled as an undocked
+// service.
+func (sn *ServiceNode) runContainer(spec ContainerSpec) error {
+	if spec.Labels == nil {
+		spec.Labels = map[string]string{}
+	}
+	spec.Labels[ServiceLabel] = "true"
+	spec.Labels[ServiceIDLabel] = spec.Name
+
+	ctx, cancel := engineCtx()
+	defer cancel()
+
+	id, err := sn.backend.CreateContainer(ctx, spec)
+	if err != nil {
+		return err
+	}
+	return sn.backend.StartContainer(ctx, id)
+}
+
+func (sn *ServiceNode) startContainer(id string) error {
+	ctx, cancel := engineCtx()
+	defer cancel()
+	return sn.backend.StartContainer(ctx, id)
+}
+
+func (sn *ServiceNode) stopAndRemove(serviceID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*engineTimeout)
+	defer cancel()
+
+	_ = sn.backend.StopContainer(ctx, serviceID, engineTimeout)
+	if err := sn.backend.RemoveContainer(ctx, serviceID, false); err == nil {
+		sn.releaseLogs(serviceID)
+	}
+
+	// A container that had already exited sends no die event to clear
+	// this, so don't wait for one.
+	sn.mu.Lock()
+	delete(sn.stopping, serviceID)
+	sn.mu.Unlock()
+}
+
+// parsePortMapping accepts the docker -p forms "container",
+// "host:container" and "ip:host:container", each optionally suffixed
+// with "/proto".
+func parsePortMapping(s string) (PortBinding, error) {
+	var b PortBinding
+
+	s, b.Protocol, _ = strings.Cut(strings.TrimSpace(s), "/")
+	if b.Protocol == "" {
+		b.Protocol = "tcp"
+	}
+
+	parts := strings.Split(s, ":")
+	switch len(parts) {
+	case 1:
+		b.ContainerPort = parts[0]
+	case 2:
+		b.HostPort, b.ContainerPort = parts[0], parts[1]
+	case 3:
+		b.HostIP, b.HostPort, b.ContainerPort = parts[0], parts[1], parts[2]
+	default:
+		return b, fmt.Errorf("invalid port mapping %q", s)
+	}
+
+	if b.ContainerPort == "" {
+		return b, errors.New("port mapping is missing a container port")
+	}
+	for _, p := range []string{b.HostPort, b.ContainerPort} {
+		if p == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+			return b, fmt.Errorf("invalid port %q in mapping", p)
+		}
+	}
+	return b, nil
+}
+
+// --------------------------
+// Listing
+// --------------------------
+
+func (sn *ServiceNode) listRunningServices() ([]Service, error) {
+	ctx, cancel := engineCtx()
+	defer cancel()
+
+	containers, err := sn.backend.ListContainers(ctx, map[string]string{ServiceLabel: "true"}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]Service, 0, len(containers))
+	for _, c := range containers {
+		services = append(services, Service{
+			ServiceID:   c.Name, // container name == ServiceID
+			DockerImage: c.Image,
+			HostPort:    c.HostPort(),
+			Status:      "running",
+			StartedAt:   c.CreatedAt.Format(time.RFC3339),
+			Profile:     c.Labels[ProfileLabel],
+		})
+	}
+
+	return services, nil
+}
@@ -0,0 +1,71 @@
+// ==========================
+// daemon.go
+// ==========================
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runDaemon runs a node without the desktop window: the service node, the
+// router and the HTTP API, until SIGINT or SIGTERM.
+func runDaemon(args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to config.json (default: config.json in the config directory)")
+	listen := fs.String("listen", "", "HTTP API address (overrides the config file)")
+	fs.Parse(args)
+
+	var (
+		cfg NodeConfig
+		err error
+	)
+	if *configPath != "" {
+		cfg, err = LoadNodeConfigFile(*configPath)
+	} else {
+		cfg, err = LoadNodeConfig()
+	}
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	if *listen != "" {
+		cfg.Listen = *listen
+	}
+	if cfg.Listen == "" {
+		return fmt.Errorf("no API listen address configured")
+	}
+
+	backend, err := NewContainerBackend(cfg.Backend)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	node := NewServiceNode(cfg, backend)
+	defer node.Close()
+
+	if err := node.InitP2P(); err != nil {
+		fmt.Println("P2P disabled:", err)
+	}
+	node.WatchContainerEvents()
+	node.StartMetricsSampler()
+	node.StartLogFollowers()
+	node.WatchProfileDir()
+
+	api, srv, err := StartAPI(node, cfg.Listen)
+	if err != nil {
+		return err
+	}
+	defer StopAPI(api, srv)
+
+	fmt.Printf("undocked daemon listening on %s (backend %s)\n", cfg.Listen, backend.Name())
+	<-ctx.Done()
+	fmt.Println("Shutting down...")
+	return nil
+}
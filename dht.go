@@ -0,0 +1,473 @@
+// ==========================
+// dht.go
+// ==========================
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"math/bits"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DHTProtocolID is a small Kademlia-style DHT spoken only by undocked
+// nodes. It stores provider records ("peer P can be found for key K") on
+// the peers whose IDs are XOR-closest to K, which is all rendezvous needs.
+// Its own protocol ID keeps it apart from the public IPFS DHT, but it is
+// not private: anyone who can reach a node may join, look up and
+// advertise. Group namespaces are hashes of the group key, so lookups
+// don't reveal group names.
+const DHTProtocolID = "/undocked/kad/1.0.0"
+
+const (
+	dhtK            = 20 // replication, result and bucket size
+	dhtAlpha        = 3  // parallel queries per lookup round
+	dhtMaxRounds    = 10
+	dhtBuckets      = 32 // by shared prefix length; deeper peers share the last
+	dhtQueryTimeout = 10 * time.Second
+	dhtMaxMessage   = 64 << 10
+	dhtProviderTTL  = 30 * time.Minute
+	dhtRefresh      = 10 * time.Minute
+	dhtFirstRefresh = 5 * time.Second
+
+	// Provider records come from anyone, so storage is bounded.
+	dhtMaxProvidersPerKey = 64
+	dhtMaxProviderKeys    = 4096
+)
+
+type dhtPeer struct {
+	ID    peer.ID  `json:"id"`
+	Addrs []string `json:"addrs"`
+}
+
+type dhtMessage struct {
+	Type      string    `json:"type"` // find_node, add_provider, get_providers
+	Key       []byte    `json:"key"`
+	Provider  *dhtPeer  `json:"provider,omitempty"`
+	Closer    []dhtPeer `json:"closer,omitempty"`
+	Providers []dhtPeer `json:"providers,omitempty"`
+}
+
+type providerRecord struct {
+	info    peer.AddrInfo
+	expires time.Time
+}
+
+// DHT is one node's view of the undocked DHT.
+type DHT struct {
+	mu        sync.Mutex
+	host      host.Host
+	self      []byte
+	buckets   [dhtBuckets][]peer.ID // least recently seen first
+	providers map[string]map[peer.ID]providerRecord
+}
+
+// NewDHT serves the DHT protocol on h. Peers are learned from bootstrap
+// addresses, from lookups and from whoever queries us.
+func NewDHT(h host.Host) *DHT {
+	d := &DHT{
+		host:      h,
+		self:      xorDistance(make([]byte, sha256.Size), h.ID()),
+		providers: map[string]map[peer.ID]providerRecord{},
+	}
+	h.SetStreamHandler(DHTProtocolID, d.handleStream)
+	return d
+}
+
+func (d *DHT) Close() {
+	d.host.RemoveStreamHandler(DHTProtocolID)
+}
+
+// Bootstrap connects to the given peers and seeds the table with them.
+// It returns how many were reachable.
+func (d *DHT) Bootstrap(ctx context.Context, peers []peer.AddrInfo) int {
+	n := 0
+	for _, p := range peers {
+		if p.ID == d.host.ID() {
+			continue
+		}
+		cctx, cancel := context.WithTimeout(ctx, dhtQueryTimeout)
+		err := d.host.Connect(cctx, p)
+		cancel()
+		if err != nil {
+			continue
+		}
+		d.addPeer(p.ID)
+		n++
+	}
+	return n
+}
+
+// dhtKey maps a rendezvous namespace to a DHT key.
+func dhtKey(namespace string) []byte {
+	sum := sha256.Sum256([]byte("undocked-rendezvous:" + namespace))
+	return sum[:]
+}
+
+// Advertise stores a provider record for us under namespace on the peers
+// closest to it.
+func (d *DHT) Advertise(ctx context.Context, namespace string) {
+	key := dhtKey(namespace)
+	self := d.selfRecord()
+
+	d.storeProvider(key, self)
+	closest, _ := d.lookup(ctx, key, false)
+	for _, p := range closest {
+		d.query(ctx, p, dhtMessage{Type: "add_provider", Key: key, Provider: &self})
+	}
+}
+
+// FindPeers returns the providers of namespace, excluding us.
+func (d *DHT) FindPeers(ctx context.Context, namespace string) []peer.AddrInfo {
+	key := dhtKey(namespace)
+	_, found := d.lookup(ctx, key, true)
+
+	for _, p := range d.localProviders(key) {
+		found = append(found, p)
+	}
+
+	seen := map[peer.ID]bool{d.host.ID(): true}
+	out := []peer.AddrInfo{}
+	for _, p := range found {
+		if seen[p.ID] {
+			continue
+		}
+		seen[p.ID] = true
+		if info, ok := toAddrInfo(p); ok {
+			out = append(out, info)
+		}
+	}
+	return out
+}
+
+// lookup walks towards key, asking the dhtAlpha closest unqueried peers
+// each round, and returns the dhtK closest peers it found along with any
+// provider records when wantProviders is set.
+func (d *DHT) lookup(ctx context.Context, key []byte, wantProviders bool) ([]peer.ID, []dhtPeer) {
+	msgType := "find_node"
+	if wantProviders {
+		msgType = "get_providers"
+	}
+
+	queried := map[peer.ID]bool{d.host.ID(): true}
+	candidates := d.closest(key, dhtK)
+	var providers []dhtPeer
+
+	for round := 0; round < dhtMaxRounds; round++ {
+		var batch []peer.ID
+		for _, p := range candidates {
+			if !queried[p] {
+				batch = append(batch, p)
+			}
+			if len(batch) == dhtAlpha {
+				break
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var (
+			wg sync.WaitGroup
+			mu sync.Mutex
+		)
+		for _, p := range batch {
+			queried[p] = true
+			wg.Add(1)
+			go func(p peer.ID) {
+				defer wg.Done()
+				resp, ok := d.query(ctx, p, dhtMessage{Type: msgType, Key: key})
+				if !ok {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				providers = append(providers, resp.Providers...)
+				for _, c := range resp.Closer {
+					if c.ID == d.host.ID() {
+						continue
+					}
+					if info, ok := toAddrInfo(c); ok {
+						d.host.Peerstore().AddAddrs(info.ID, info.Addrs, time.Hour)
+						d.addPeer(info.ID)
+					}
+				}
+			}(p)
+		}
+		wg.Wait()
+
+		candidates = d.closest(key, dhtK)
+	}
+
+	var out []peer.ID
+	for _, p := range candidates {
+		if queried[p] {
+			out = append(out, p)
+		}
+	}
+	return out, providers
+}
+
+// query sends one request to p and reads its reply. Peers that don't
+// answer are dropped from the table.
+func (d *DHT) query(ctx context.Context, p peer.ID, req dhtMessage) (dhtMessage, bool) {
+	ctx, cancel := context.WithTimeout(ctx, dhtQueryTimeout)
+	defer cancel()
+
+	s, err := d.host.NewStream(ctx, p, DHTProtocolID)
+	if err != nil {
+		d.removePeer(p)
+		return dhtMessage{}, false
+	}
+	defer s.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		s.SetDeadline(dl)
+	}
+
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		s.Reset()
+		return dhtMessage{}, false
+	}
+	s.CloseWrite()
+
+	var resp dhtMessage
+	if err := json.NewDecoder(io.LimitReader(s, dhtMaxMessage)).Decode(&resp); err != nil {
+		s.Reset()
+		return dhtMessage{}, false
+	}
+	d.addPeer(p)
+	return resp, true
+}
+
+func (d *DHT) handleStream(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(dhtQueryTimeout))
+
+	var req dhtMessage
+	if err := json.NewDecoder(io.LimitReader(s, dhtMaxMessage)).Decode(&req); err != nil || len(req.Key) != sha256.Size {
+		s.Reset()
+		return
+	}
+
+	remote := s.Conn().RemotePeer()
+	d.addPeer(remote)
+
+	var resp dhtMessage
+	switch req.Type {
+	case "find_node":
+	case "get_providers":
+		resp.Providers = d.localProviders(req.Key)
+	case "add_provider":
+		// Peers may only register themselves.
+		if req.Provider != nil && req.Provider.ID == remote {
+			if info, ok := toAddrInfo(*req.Provider); ok {
+				d.storeProvider(req.Key, dhtPeer{ID: info.ID, Addrs: req.Provider.Addrs})
+			}
+		}
+	default:
+		s.Reset()
+		return
+	}
+
+	for _, p := range d.closest(req.Key, dhtK) {
+		if p == remote {
+			continue
+		}
+		resp.Closer = append(resp.Closer, d.record(p))
+	}
+	json.NewEncoder(s).Encode(resp)
+}
+
+// --------------------------
+// Routing table and records
+// --------------------------
+
+// bucket picks p's k-bucket: the number of leading bits its hashed ID
+// shares with ours.
+func (d *DHT) bucket(p peer.ID) int {
+	dist := xorDistance(d.self, p)
+	n := 0
+	for _, b := range dist {
+		if b != 0 {
+			n += bits.LeadingZeros8(b)
+			break
+		}
+		n += 8
+	}
+	return min(n, dhtBuckets-1)
+}
+
+// addPeer marks p as just seen. A full bucket makes room by evicting its
+// least recently seen peer if we are no longer connected to it; otherwise
+// the newcomer is dropped, as Kademlia prefers long-lived peers.
+func (d *DHT) addPeer(p peer.ID) {
+	if p == d.host.ID() {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	i := d.bucket(p)
+	b := d.buckets[i]
+	if j := slices.Index(b, p); j >= 0 {
+		d.buckets[i] = append(slices.Delete(b, j, j+1), p)
+		return
+	}
+	if len(b) >= dhtK {
+		if d.host.Network().Connectedness(b[0]) == network.Connected {
+			return
+		}
+		b = b[1:]
+	}
+	d.buckets[i] = append(b, p)
+}
+
+func (d *DHT) removePeer(p peer.ID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i := d.bucket(p)
+	if j := slices.Index(d.buckets[i], p); j >= 0 {
+		d.buckets[i] = slices.Delete(d.buckets[i], j, j+1)
+	}
+}
+
+// closest returns up to n table peers ordered by XOR distance to key.
+func (d *DHT) closest(key []byte, n int) []peer.ID {
+	d.mu.Lock()
+	var peers []peer.ID
+	for _, b := range d.buckets {
+		peers = append(peers, b...)
+	}
+	d.mu.Unlock()
+
+	dist := make(map[peer.ID][]byte, len(peers))
+	for _, p := range peers {
+		dist[p] = xorDistance(key, p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return bytes.Compare(dist[peers[i]], dist[peers[j]]) < 0
+	})
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+func xorDistance(key []byte, p peer.ID) []byte {
+	h := sha256.Sum256([]byte(p))
+	out := make([]byte, len(h))
+	for i := range h {
+		out[i] = h[i] ^ key[i]
+	}
+	return out
+}
+
+// storeProvider records p under key. Once a key holds
+// dhtMaxProvidersPerKey records the one closest to expiry makes way; new
+// keys are refused while dhtMaxProviderKeys are live.
+func (d *DHT) storeProvider(key []byte, p dhtPeer) {
+	info, ok := toAddrInfo(p)
+	if !ok {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	k := string(key)
+	recs := d.providers[k]
+	if recs == nil {
+		if len(d.providers) >= dhtMaxProviderKeys {
+			d.pruneProviders(now)
+			if len(d.providers) >= dhtMaxProviderKeys {
+				return
+			}
+		}
+		recs = map[peer.ID]providerRecord{}
+		d.providers[k] = recs
+	}
+
+	if _, ok := recs[info.ID]; !ok && len(recs) >= dhtMaxProvidersPerKey {
+		var oldest peer.ID
+		for id, rec := range recs {
+			if oldest == "" || rec.expires.Before(recs[oldest].expires) {
+				oldest = id
+			}
+		}
+		delete(recs, oldest)
+	}
+	recs[info.ID] = providerRecord{info: info, expires: now.Add(dhtProviderTTL)}
+}
+
+// pruneProviders drops expired records and empty keys. Callers hold d.mu.
+func (d *DHT) pruneProviders(now time.Time) {
+	for k, recs := range d.providers {
+		for id, rec := range recs {
+			if now.After(rec.expires) {
+				delete(recs, id)
+			}
+		}
+		if len(recs) == 0 {
+			delete(d.providers, k)
+		}
+	}
+}
+
+func (d *DHT) localProviders(key []byte) []dhtPeer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	var out []dhtPeer
+	for id, rec := range d.providers[string(key)] {
+		if now.After(rec.expires) {
+			delete(d.providers[string(key)], id)
+			continue
+		}
+		out = append(out, infoRecord(rec.info))
+		if len(out) == dhtK {
+			break
+		}
+	}
+	return out
+}
+
+func (d *DHT) selfRecord() dhtPeer {
+	return infoRecord(peer.AddrInfo{ID: d.host.ID(), Addrs: d.host.Addrs()})
+}
+
+func (d *DHT) record(p peer.ID) dhtPeer {
+	return infoRecord(d.host.Peerstore().PeerInfo(p))
+}
+
+func infoRecord(info peer.AddrInfo) dhtPeer {
+	r := dhtPeer{ID: info.ID}
+	for _, a := range info.Addrs {
+		r.Addrs = append(r.Addrs, a.String())
+	}
+	return r
+}
+
+func toAddrInfo(r dhtPeer) (peer.AddrInfo, bool) {
+	if r.ID.Validate() != nil {
+		return peer.AddrInfo{}, false
+	}
+	info := peer.AddrInfo{ID: r.ID}
+	for _, s := range r.Addrs {
+		if a, err := ma.NewMultiaddr(s); err == nil {
+			info.Addrs = append(info.Addrs, a)
+		}
+	}
+	return info, len(info.Addrs) > 0
+}
@@ -0,0 +1,150 @@
+// ==========================
+// dht_test.go
+// ==========================
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+)
+
+func newTestHost(t *testing.T) host.Host {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// Hosts that only share a bootstrap node find each other through provider
+// records, as dhtLoop does for every topic.
+func TestDHTFindPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const n = 6
+	hosts := make([]host.Host, n)
+	dhts := make([]*DHT, n)
+	for i := range hosts {
+		hosts[i] = newTestHost(t)
+		dhts[i] = NewDHT(hosts[i])
+		t.Cleanup(dhts[i].Close)
+	}
+
+	boot := []peer.AddrInfo{{ID: hosts[0].ID(), Addrs: hosts[0].Addrs()}}
+	for _, d := range dhts[1:] {
+		if d.Bootstrap(ctx, boot) != 1 {
+			t.Fatal("bootstrap peer unreachable")
+		}
+	}
+
+	const ns = "undocked-services"
+	for _, d := range dhts[1:] {
+		d.Advertise(ctx, ns)
+	}
+
+	// The bootstrap node holds records; the last node only dialled it.
+	for _, i := range []int{0, n - 1} {
+		found := map[peer.ID]bool{}
+		for _, info := range dhts[i].FindPeers(ctx, ns) {
+			found[info.ID] = true
+		}
+		for j, h := range hosts[1:] {
+			if j+1 != i && !found[h.ID()] {
+				t.Errorf("node %d did not find %s", i, h.ID())
+			}
+		}
+		if found[hosts[i].ID()] {
+			t.Errorf("node %d found itself", i)
+		}
+	}
+
+	if got := dhts[1].FindPeers(ctx, "undocked-group-nobody"); len(got) != 0 {
+		t.Errorf("unadvertised namespace returned %d peers", len(got))
+	}
+}
+
+func TestDHTProviderBounds(t *testing.T) {
+	d := NewDHT(newTestHost(t))
+	defer d.Close()
+
+	record := func() dhtPeer {
+		return dhtPeer{ID: test.RandPeerIDFatal(t), Addrs: []string{"/ip4/127.0.0.1/tcp/4001"}}
+	}
+
+	key := dhtKey("flood")
+	for i := 0; i < dhtMaxProvidersPerKey+10; i++ {
+		d.storeProvider(key, record())
+	}
+	if got := len(d.providers[string(key)]); got != dhtMaxProvidersPerKey {
+		t.Errorf("key holds %d records, want %d", got, dhtMaxProvidersPerKey)
+	}
+
+	for i := 0; len(d.providers) < dhtMaxProviderKeys; i++ {
+		d.storeProvider(dhtKey(string(rune(i))+"-fill"), record())
+	}
+	d.storeProvider(dhtKey("one-too-many"), record())
+	if len(d.providers) != dhtMaxProviderKeys {
+		t.Errorf("%d keys stored, want at most %d", len(d.providers), dhtMaxProviderKeys)
+	}
+	if _, ok := d.providers[string(dhtKey("one-too-many"))]; ok {
+		t.Error("new key accepted past the limit")
+	}
+}
+
+// A full bucket replaces peers we lost touch with but keeps live ones.
+func TestDHTBucketEviction(t *testing.T) {
+	h := newTestHost(t)
+	d := NewDHT(h)
+	defer d.Close()
+
+	// Random IDs land in bucket i with probability 2^-(i+1); keep the live
+	// peer in a shallow one so the bucket is quick to fill.
+	live := newTestHost(t)
+	for d.bucket(live.ID()) > 2 {
+		live = newTestHost(t)
+	}
+	if err := h.Connect(context.Background(), peer.AddrInfo{ID: live.ID(), Addrs: live.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	i := d.bucket(live.ID())
+
+	randomIn := func() peer.ID {
+		for {
+			if p := test.RandPeerIDFatal(t); d.bucket(p) == i {
+				return p
+			}
+		}
+	}
+
+	// Peers we aren't connected to make way.
+	stale := randomIn()
+	d.addPeer(stale)
+	for len(d.buckets[i]) < dhtK {
+		d.addPeer(randomIn())
+	}
+	d.addPeer(live.ID())
+	if slices.Contains(d.buckets[i], stale) || !slices.Contains(d.buckets[i], live.ID()) {
+		t.Fatal("stale peer not replaced by live one")
+	}
+
+	// A connected peer at the head keeps its place.
+	d.buckets[i] = []peer.ID{live.ID()}
+	for len(d.buckets[i]) < dhtK {
+		d.addPeer(randomIn())
+	}
+	newcomer := randomIn()
+	d.addPeer(newcomer)
+	if d.buckets[i][0] != live.ID() || slices.Contains(d.buckets[i], newcomer) {
+		t.Error("live peer evicted for a newcomer")
+	}
+}
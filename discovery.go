@@ -0,0 +1,118 @@
+// ==========================
+// discovery.go
+// ==========================
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+)
+
+// mdnsServiceName is the DNS-SD service undocked nodes advertise on the
+// LAN. It differs from libp2p's default so we only find each other.
+const mdnsServiceName = "_undocked._udp"
+
+const discoveryConnectTimeout = 10 * time.Second
+
+// DiscoveredPeer is emitted as "peer-discovered" when a discovery
+// mechanism finds a node we weren't connected to.
+type DiscoveredPeer struct {
+	ID     string   `json:"id"`
+	Addrs  []string `json:"addrs"`
+	Source string   `json:"source"`
+}
+
+// startMDNS advertises this node on the local network and connects to the
+// undocked nodes it hears about.
+func (sn *ServiceNode) startMDNS() error {
+	svc := mdns.NewMdnsService(sn.host, mdnsServiceName, discoveryNotifee{sn: sn, source: "mdns"})
+	if err := svc.Start(); err != nil {
+		return err
+	}
+	go func() {
+		<-sn.ctx.Done()
+		svc.Close()
+	}()
+	return nil
+}
+
+type discoveryNotifee struct {
+	sn     *ServiceNode
+	source string
+}
+
+func (n discoveryNotifee) HandlePeerFound(info peer.AddrInfo) {
+	n.sn.connectDiscovered(info, n.source)
+}
+
+// connectDiscovered dials a discovered peer unless it is us or already
+// connected. GossipSub takes it from there.
+func (sn *ServiceNode) connectDiscovered(info peer.AddrInfo, source string) {
+	if info.ID == sn.host.ID() || len(sn.host.Network().ConnsToPeer(info.ID)) > 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(sn.ctx, discoveryConnectTimeout)
+	defer cancel()
+	if err := sn.host.Connect(ctx, info); err != nil {
+		return
+	}
+
+	d := DiscoveredPeer{ID: info.ID.String(), Source: source}
+	for _, a := range info.Addrs {
+		d.Addrs = append(d.Addrs, a.String())
+	}
+	fmt.Printf("Discovered peer %s via %s\n", d.ID, source)
+	sn.emit("peer-discovered", d)
+
+	if sn.dht != nil {
+		sn.dht.addPeer(info.ID)
+	}
+}
+
+// startDHT joins the undocked DHT through the configured bootstrap peers,
+// then periodically advertises this node under each topic it is on (the
+// public one and every group's) and connects to everyone else found there.
+func (sn *ServiceNode) startDHT() error {
+	var bootstrap []peer.AddrInfo
+	for _, s := range sn.cfg.BootstrapPeers {
+		info, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			return fmt.Errorf("bootstrap peer %q: %w", s, err)
+		}
+		bootstrap = append(bootstrap, *info)
+	}
+
+	sn.dht = NewDHT(sn.host)
+	go sn.dhtLoop(bootstrap)
+	return nil
+}
+
+func (sn *ServiceNode) dhtLoop(bootstrap []peer.AddrInfo) {
+	defer sn.dht.Close()
+
+	timer := time.NewTimer(dhtFirstRefresh)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-sn.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		sn.dht.Bootstrap(sn.ctx, bootstrap)
+		for _, ch := range sn.channelList() {
+			sn.dht.Advertise(sn.ctx, ch.name)
+			for _, info := range sn.dht.FindPeers(sn.ctx, ch.name) {
+				sn.connectDiscovered(info, "dht")
+			}
+		}
+
+		timer.Reset(dhtRefresh)
+	}
+}
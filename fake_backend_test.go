@@ -0,0 +1,512 @@
+// ==========================
+// fake_backend_test.go
+// ==========================
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FakeBackend is an in-memory ContainerBackend. Containers never run
+// anything; they only move between states, which is enough to drive
+// ServiceNode without a real engine.
+type FakeBackend struct {
+	mu         sync.Mutex
+	images     map[string]struct{}
+	containers map[string]*ContainerInfo
+	watchers   map[chan ContainerEvent]struct{}
+	stats      map[string]ContainerStatsSample
+	logs       map[string][]LogLine
+	followers  map[chan LogLine]string
+	execCodes  map[string]int
+	volumes    map[string]*VolumeInfo
+	down       bool
+	failStarts int
+}
+
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		images:     map[string]struct{}{},
+		containers: map[string]*ContainerInfo{},
+		watchers:   map[chan ContainerEvent]struct{}{},
+		stats:      map[string]ContainerStatsSample{},
+		logs:       map[string][]LogLine{},
+		followers:  map[chan LogLine]string{},
+		execCodes:  map[string]int{},
+		volumes:    map[string]*VolumeInfo{},
+	}
+}
+
+// SetDown makes Ping fail, as if the engine had stopped.
+func (f *FakeBackend) SetDown(down bool) {
+	f.mu.Lock()
+	f.down = down
+	f.mu.Unlock()
+}
+
+// FailStarts makes the next n StartContainer calls fail.
+func (f *FakeBackend) FailStarts(n int) {
+	f.mu.Lock()
+	f.failStarts = n
+	f.mu.Unlock()
+}
+
+// Exit marks a running container as exited with code.
+func (f *FakeBackend) Exit(id string, code int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.lookup(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, id)
+	}
+	if !c.Running {
+		return nil
+	}
+	c.Running = false
+	c.State = "exited"
+	c.ExitCode = code
+	f.emit(c, "die")
+
+	for ch, cid := range f.followers {
+		if cid == c.ID {
+			close(ch)
+			delete(f.followers, ch)
+		}
+	}
+	return nil
+}
+
+func (f *FakeBackend) Name() string {
+	return "fake"
+}
+
+func (f *FakeBackend) Ping(_ context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return fmt.Errorf("fake backend is down")
+	}
+	return nil
+}
+
+// --------------------------
+// Images
+// --------------------------
+
+func (f *FakeBackend) ImageExists(_ context.Context, image string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.images[image]
+	return ok, nil
+}
+
+func (f *FakeBackend) PullImage(_ context.Context, image string, logFn func(string)) error {
+	f.mu.Lock()
+	f.images[image] = struct{}{}
+	f.mu.Unlock()
+
+	if logFn != nil {
+		logFn("pulled " + image)
+	}
+	return nil
+}
+
+// --------------------------
+// Containers
+// --------------------------
+
+func (f *FakeBackend) CreateContainer(_ context.Context, spec ContainerSpec) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.images[spec.Image]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrImageNotFound, spec.Image)
+	}
+	if _, ok := f.lookup(spec.Name); ok && spec.Name != "" {
+		return "", fmt.Errorf("container name %q already in use", spec.Name)
+	}
+	for _, m := range spec.Mounts {
+		if m.Type != "volume" {
+			continue
+		}
+		if _, ok := f.volumes[m.Source]; !ok {
+			f.volumes[m.Source] = &VolumeInfo{Name: m.Source, Driver: "local", Labels: map[string]string{}}
+		}
+	}
+
+	labels := map[string]string{}
+	for k, v := range spec.Labels {
+		labels[k] = v
+	}
+
+	c := &ContainerInfo{
+		ID:        uuid.NewString(),
+		Name:      spec.Name,
+		Image:     spec.Image,
+		Labels:    labels,
+		State:     "created",
+		Ports:     append([]PortBinding(nil), spec.Ports...),
+		Mounts:    append([]Mount(nil), spec.Mounts...),
+		CreatedAt: time.Now(),
+	}
+	f.containers[c.ID] = c
+	return c.ID, nil
+}
+
+func (f *FakeBackend) StartContainer(_ context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.lookup(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, id)
+	}
+	if f.failStarts > 0 {
+		f.failStarts--
+		return errors.New("fake: start failed")
+	}
+	if !c.Running {
+		c.Running = true
+		c.State = "running"
+		c.ExitCode = 0
+		c.StartedAt = time.Now()
+		f.emit(c, "start")
+	}
+	return nil
+}
+
+func (f *FakeBackend) StopContainer(_ context.Context, id string, _ time.Duration) error {
+	return f.Exit(id, 0)
+}
+
+func (f *FakeBackend) RemoveContainer(_ context.Context, id string, force bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.lookup(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, id)
+	}
+	if c.Running && !force {
+		return fmt.Errorf("container %s is running", id)
+	}
+	delete(f.containers, c.ID)
+	f.emit(c, "destroy")
+	return nil
+}
+
+func (f *FakeBackend) InspectContainer(_ context.Context, id string) (ContainerInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.lookup(id)
+	if !ok {
+		return ContainerInfo{}, fmt.Errorf("%w: %s", ErrContainerNotFound, id)
+	}
+	return *c, nil
+}
+
+func (f *FakeBackend) ListContainers(_ context.Context, labels map[string]string, all bool) ([]ContainerInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := []ContainerInfo{}
+	for _, c := range f.containers {
+		if !all && !c.Running {
+			continue
+		}
+		if !hasLabels(c.Labels, labels) {
+			continue
+		}
+		out = append(out, *c)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+// --------------------------
+// Volumes
+// --------------------------
+
+func (f *FakeBackend) CreateVolume(_ context.Context, name string, labels map[string]string) (VolumeInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if v, ok := f.volumes[name]; ok {
+		return *v, nil
+	}
+
+	l := map[string]string{}
+	for k, v := range labels {
+		l[k] = v
+	}
+	v := &VolumeInfo{
+		Name:       name,
+		Driver:     "local",
+		Mountpoint: "/fake/volumes/" + name,
+		Labels:     l,
+		CreatedAt:  time.Now().Format(time.RFC3339),
+	}
+	f.volumes[name] = v
+	return *v, nil
+}
+
+func (f *FakeBackend) InspectVolume(_ context.Context, name string) (VolumeInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	v, ok := f.volumes[name]
+	if !ok {
+		return VolumeInfo{}, fmt.Errorf("%w: %s", ErrVolumeNotFound, name)
+	}
+	return *v, nil
+}
+
+func (f *FakeBackend) ListVolumes(_ context.Context, labels map[string]string) ([]VolumeInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := []VolumeInfo{}
+	for _, v := range f.volumes {
+		if hasLabels(v.Labels, labels) {
+			out = append(out, *v)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+func (f *FakeBackend) RemoveVolume(_ context.Context, name string, force bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.volumes[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrVolumeNotFound, name)
+	}
+	if !force {
+		for _, c := range f.containers {
+			for _, m := range c.Mounts {
+				if m.Type == "volume" && m.Source == name {
+					return fmt.Errorf("volume %s is in use by %s", name, c.Name)
+				}
+			}
+		}
+	}
+	delete(f.volumes, name)
+	return nil
+}
+
+// --------------------------
+// Stats
+// --------------------------
+
+// SetStats fixes the sample ContainerStats returns for a container.
+func (f *FakeBackend) SetStats(id string, sample ContainerStatsSample) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.lookup(id); ok {
+		id = c.ID
+	}
+	f.stats[id] = sample
+}
+
+func (f *FakeBackend) ContainerStats(_ context.Context, id string) (ContainerStatsSample, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.lookup(id)
+	if !ok {
+		return ContainerStatsSample{}, fmt.Errorf("%w: %s", ErrContainerNotFound, id)
+	}
+	sample := f.stats[c.ID]
+	sample.Time = time.Now()
+	return sample, nil
+}
+
+// SetExecExitCode fixes the exit code ExecContainer reports for a
+// container, e.g. to fail its health check.
+func (f *FakeBackend) SetExecExitCode(id string, code int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.lookup(id); ok {
+		id = c.ID
+	}
+	f.execCodes[id] = code
+}
+
+func (f *FakeBackend) ExecContainer(_ context.Context, id string, _ []string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.lookup(id)
+	if !ok {
+		return -1, fmt.Errorf("%w: %s", ErrContainerNotFound, id)
+	}
+	if !c.Running {
+		return -1, fmt.Errorf("container %s is not running", id)
+	}
+	return f.execCodes[c.ID], nil
+}
+
+// --------------------------
+// Logs
+// --------------------------
+
+// WriteLog appends a line to a container's output as if it had printed it.
+func (f *FakeBackend) WriteLog(id, stream, message string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.lookup(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, id)
+	}
+
+	line := LogLine{Stream: stream, Time: time.Now(), Message: message}
+	f.logs[c.ID] = append(f.logs[c.ID], line)
+
+	for ch, cid := range f.followers {
+		if cid != c.ID {
+			continue
+		}
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+	return nil
+}
+
+func (f *FakeBackend) FollowLogs(ctx context.Context, id string, since time.Time, fn func(LogLine)) error {
+	f.mu.Lock()
+	c, ok := f.lookup(id)
+	if !ok {
+		f.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, id)
+	}
+
+	var backlog []LogLine
+	for _, l := range f.logs[c.ID] {
+		if l.Time.After(since) {
+			backlog = append(backlog, l)
+		}
+	}
+
+	if !c.Running {
+		f.mu.Unlock()
+		for _, l := range backlog {
+			fn(l)
+		}
+		return nil
+	}
+
+	ch := make(chan LogLine, 256)
+	f.followers[ch] = c.ID
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.followers, ch)
+		f.mu.Unlock()
+	}()
+
+	for _, l := range backlog {
+		fn(l)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case l, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			fn(l)
+		}
+	}
+}
+
+// --------------------------
+// Events
+// --------------------------
+
+func (f *FakeBackend) WatchEvents(ctx context.Context, labels map[string]string, fn func(ContainerEvent)) error {
+	ch := make(chan ContainerEvent, 64)
+
+	f.mu.Lock()
+	f.watchers[ch] = struct{}{}
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.watchers, ch)
+		f.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev := <-ch:
+			if hasLabels(ev.Labels, labels) {
+				fn(ev)
+			}
+		}
+	}
+}
+
+// emit fans an event out to watchers. Callers hold f.mu; slow watchers
+// drop events rather than block the backend.
+func (f *FakeBackend) emit(c *ContainerInfo, action string) {
+	ev := ContainerEvent{
+		ID:       c.ID,
+		Name:     c.Name,
+		Action:   action,
+		ExitCode: c.ExitCode,
+		Labels:   c.Labels,
+		Time:     time.Now(),
+	}
+	for ch := range f.watchers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// lookup resolves a container by ID or name, like the engine does.
+func (f *FakeBackend) lookup(ref string) (*ContainerInfo, bool) {
+	if c, ok := f.containers[ref]; ok {
+		return c, true
+	}
+	for _, c := range f.containers {
+		if c.Name == ref {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+func hasLabels(have, want map[string]string) bool {
+	for k, v := range want {
+		got, ok := have[k]
+		if !ok || (v != "" && got != v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,332 @@
+// ==========================
+// groups.go
+// ==========================
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	groupsFileName = "groups.json"
+	invitePrefix   = "undocked-invite:"
+	groupKeySize   = 32
+
+	// publicGroup stands for the public topic in a profile's groups.
+	publicGroup = "public"
+)
+
+var ErrGroupNotFound = errors.New("group not found")
+
+// Group is a private set of friends. Announcements for a group go on its
+// own topic, sealed with the group key, so only members can read them or
+// forge them. The topic name is derived from the key, so knowing the
+// group's name isn't enough to find it.
+//
+// We encrypt announcements rather than use a libp2p private network
+// (PSK): a PSK applies to the whole host, which would keep a node from
+// being in several groups and on the public topic at once.
+type Group struct {
+	Name string `json:"name"`
+	Key  []byte `json:"key"`
+}
+
+// GroupInfo is what the UI shows for a group.
+type GroupInfo struct {
+	Name    string `json:"name"`
+	Topic   string `json:"topic"`
+	Members int    `json:"members"`
+}
+
+type groupInvite struct {
+	Name  string   `json:"n"`
+	Key   []byte   `json:"k"`
+	Peers []string `json:"p,omitempty"`
+}
+
+func (g Group) topic() string {
+	sum := sha256.Sum256(append([]byte("undocked-group-topic:"), g.Key...))
+	return "undocked-group-" + hex.EncodeToString(sum[:8])
+}
+
+// seal encrypts an announcement with AES-256-GCM. The topic is bound in as
+// additional data so a message can't be replayed into another group.
+func (g Group) seal(plain []byte) ([]byte, error) {
+	aead, err := g.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, []byte(g.topic())), nil
+}
+
+func (g Group) open(sealed []byte) ([]byte, error) {
+	aead, err := g.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed message too short")
+	}
+	nonce, data := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, data, []byte(g.topic()))
+}
+
+func (g Group) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(g.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// --------------------------
+// Storage
+// --------------------------
+
+func (sn *ServiceNode) groupsPath() string {
+	return filepath.Join(sn.cfg.Dir, groupsFileName)
+}
+
+func (sn *ServiceNode) loadGroups() error {
+	data, err := os.ReadFile(sn.groupsPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var groups []Group
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return err
+	}
+
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	for _, g := range groups {
+		if len(g.Key) == groupKeySize {
+			sn.groups[g.Name] = g
+		}
+	}
+	return nil
+}
+
+// saveGroups writes the groups owner-only; the file holds their keys.
+// Callers hold sn.mu.
+func (sn *ServiceNode) saveGroups() error {
+	groups := make([]Group, 0, len(sn.groups))
+	for _, g := range sn.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(sn.groupsPath(), data, 0o600)
+}
+
+// --------------------------
+// Operations
+// --------------------------
+
+// CreateGroup makes a new group with a fresh key and returns an invite for
+// it.
+func (sn *ServiceNode) CreateGroup(name string) (string, error) {
+	if !profileNamePattern.MatchString(name) || name == publicGroup {
+		return "", fmt.Errorf("invalid group name %q", name)
+	}
+
+	g := Group{Name: name, Key: make([]byte, groupKeySize)}
+	if _, err := rand.Read(g.Key); err != nil {
+		return "", err
+	}
+
+	if err := sn.addGroup(g); err != nil {
+		return "", err
+	}
+	return sn.GroupInvite(name)
+}
+
+// GroupInvite returns a token a friend can paste to join. It carries the
+// group key, so share it privately, and our addresses so the friend can
+// reach us right away.
+func (sn *ServiceNode) GroupInvite(name string) (string, error) {
+	sn.mu.Lock()
+	g, ok := sn.groups[name]
+	sn.mu.Unlock()
+	if !ok {
+		return "", ErrGroupNotFound
+	}
+
+	inv := groupInvite{Name: g.Name, Key: g.Key}
+	if sn.host != nil {
+		if addrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: sn.host.ID(), Addrs: sn.host.Addrs()}); err == nil {
+			for _, a := range addrs {
+				inv.Peers = append(inv.Peers, a.String())
+			}
+		}
+	}
+
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return "", err
+	}
+	return invitePrefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// JoinGroup joins the group in an invite token and dials the inviter.
+func (sn *ServiceNode) JoinGroup(token string) (Group, error) {
+	raw, ok := strings.CutPrefix(strings.TrimSpace(token), invitePrefix)
+	if !ok {
+		return Group{}, errors.New("not an undocked invite")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return Group{}, fmt.Errorf("malformed invite: %w", err)
+	}
+
+	var inv groupInvite
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return Group{}, fmt.Errorf("malformed invite: %w", err)
+	}
+	if !profileNamePattern.MatchString(inv.Name) || inv.Name == publicGroup || len(inv.Key) != groupKeySize {
+		return Group{}, errors.New("malformed invite")
+	}
+
+	g := Group{Name: inv.Name, Key: inv.Key}
+	if err := sn.addGroup(g); err != nil {
+		return Group{}, err
+	}
+
+	if sn.host != nil {
+		for _, s := range inv.Peers {
+			if info, err := peer.AddrInfoFromString(s); err == nil {
+				go sn.connectDiscovered(*info, "invite")
+			}
+		}
+	}
+	return g, nil
+}
+
+func (sn *ServiceNode) addGroup(g Group) error {
+	sn.mu.Lock()
+	if old, ok := sn.groups[g.Name]; ok {
+		sn.mu.Unlock()
+		if string(old.Key) == string(g.Key) {
+			return nil
+		}
+		return fmt.Errorf("a different group named %q already exists", g.Name)
+	}
+	sn.groups[g.Name] = g
+	err := sn.saveGroups()
+	sn.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if sn.ps != nil {
+		if err := sn.joinChannel(&g); err != nil {
+			return err
+		}
+		sn.BroadcastServices()
+	}
+	return nil
+}
+
+func (sn *ServiceNode) LeaveGroup(name string) error {
+	sn.mu.Lock()
+	g, ok := sn.groups[name]
+	if !ok {
+		sn.mu.Unlock()
+		return ErrGroupNotFound
+	}
+	delete(sn.groups, name)
+	err := sn.saveGroups()
+	sn.mu.Unlock()
+
+	sn.leaveChannel(g.topic())
+	return err
+}
+
+func (sn *ServiceNode) ListGroups() []GroupInfo {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	out := make([]GroupInfo, 0, len(sn.groups))
+	for _, g := range sn.groups {
+		topic := g.topic()
+		members := 0
+		for _, views := range sn.peerViews {
+			if _, ok := views[topic]; ok {
+				members++
+			}
+		}
+		out = append(out, GroupInfo{Name: g.Name, Topic: topic, Members: members})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// sharesGroup reports whether peerID is a current member of one of groups,
+// or of any group we are in when groups is empty. Membership means it has
+// announced on the group's sealed topic within peerTTL, which needs the
+// group key.
+func (sn *ServiceNode) sharesGroup(peerID string, groups []string) bool {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	views := sn.peerViews[peerID]
+	for name, g := range sn.groups {
+		if len(groups) > 0 && !slices.Contains(groups, name) {
+			continue
+		}
+		if _, ok := views[g.topic()]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleIn reports whether a service may be announced in group ("" being
+// the public topic). Profiles that list groups are only announced there,
+// and profiles without exposeHTTP nowhere.
+func (sn *ServiceNode) visibleIn(s Service, group string) bool {
+	p, ok := sn.config.Get(s.Profile)
+	if ok && !p.ExposeHTTP {
+		return false
+	}
+	if !ok || len(p.Groups) == 0 {
+		return true
+	}
+	if group == "" {
+		group = publicGroup
+	}
+	for _, g := range p.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
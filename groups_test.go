@@ -0,0 +1,141 @@
+// ==========================
+// groups_test.go
+// ==========================
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+)
+
+// testGroup derives a fixed key from the name.
+func testGroup(name string) Group {
+	key := sha256.Sum256([]byte(name))
+	return Group{Name: name, Key: key[:]}
+}
+
+func TestGroupSealOpen(t *testing.T) {
+	g, other := testGroup("friends"), testGroup("family")
+	plain := []byte("announcement")
+
+	sealed, err := g.seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := g.open(sealed); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("open: %q, %v", got, err)
+	}
+	if bytes.Contains(sealed, plain) {
+		t.Error("sealed message contains the plaintext")
+	}
+
+	if _, err := other.open(sealed); err == nil {
+		t.Error("opened with a foreign key")
+	}
+
+	// The topic is authenticated: the same ciphertext replayed onto
+	// another topic doesn't open even with the right key.
+	aead, err := g.aead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := aead.NonceSize()
+	if _, err := aead.Open(nil, sealed[:n], sealed[n:], []byte(other.topic())); err == nil {
+		t.Error("opened with another topic as additional data")
+	}
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := g.open(tampered); err == nil {
+		t.Error("opened a tampered message")
+	}
+	if _, err := g.open(sealed[:n-1]); err == nil {
+		t.Error("opened a truncated message")
+	}
+}
+
+func TestJoinGroupInvites(t *testing.T) {
+	sn, _ := newTestNode(t)
+
+	invite, err := sn.CreateGroup("friends")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	joiner, _ := newTestNode(t)
+	g, err := joiner.JoinGroup(invite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.topic() != sn.groups["friends"].topic() {
+		t.Error("joined a different topic than the inviter's")
+	}
+
+	encode := func(s string) string {
+		return invitePrefix + base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, groupKeySize))
+	for name, token := range map[string]string{
+		"no prefix":     "friends",
+		"bad base64":    invitePrefix + "!!!",
+		"bad json":      encode("{"),
+		"short key":     encode(`{"n":"friends","k":"AAAA"}`),
+		"no key":        encode(`{"n":"friends"}`),
+		"bad name":      encode(`{"n":"-x","k":"` + key + `"}`),
+		"public":        encode(`{"n":"public","k":"` + key + `"}`),
+		"name conflict": encode(`{"n":"friends","k":"` + key + `"}`),
+	} {
+		if _, err := joiner.JoinGroup(token); err == nil {
+			t.Errorf("%s: invite accepted", name)
+		}
+	}
+	if got := joiner.ListGroups(); len(got) != 1 {
+		t.Errorf("groups after bad invites: %+v", got)
+	}
+}
+
+// Only announcing on a group's sealed topic makes a peer a member, which
+// is what authRequired and group-only profiles check.
+func TestSharesGroup(t *testing.T) {
+	sn, _ := newTestNode(t)
+	friends, family := testGroup("friends"), testGroup("family")
+	for _, g := range []Group{friends, family} {
+		if err := sn.addGroup(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	announce := func(ch *gossipChannel, from string) {
+		m := wireMessage{Type: wireAnnounce, PeerID: from, Seq: 1, Services: []Service{}}
+		if _, ok := sn.updatePeer(ch, m); !ok {
+			t.Fatalf("announcement from %s on %s ignored", from, ch.name)
+		}
+	}
+
+	public := &gossipChannel{name: servicesTopic}
+	announce(public, "stranger")
+	if sn.sharesGroup("stranger", nil) || sn.sharesGroup("stranger", []string{"friends"}) {
+		t.Error("peer seen only on the public topic counts as a member")
+	}
+	if sn.sharesGroup("nobody", nil) {
+		t.Error("unknown peer counts as a member")
+	}
+
+	announce(public, "friend")
+	announce(&gossipChannel{name: friends.topic(), group: &friends}, "friend")
+	if !sn.sharesGroup("friend", nil) || !sn.sharesGroup("friend", []string{"friends"}) {
+		t.Error("member of friends not recognised")
+	}
+	if sn.sharesGroup("friend", []string{"family"}) {
+		t.Error("member of friends counts for family")
+	}
+
+	if err := sn.LeaveGroup("friends"); err != nil {
+		t.Fatal(err)
+	}
+	if sn.sharesGroup("friend", nil) {
+		t.Error("membership outlives leaving the group")
+	}
+}
@@ -0,0 +1,218 @@
+// ==========================
+// health.go
+// ==========================
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health states reported on Service.Health. Services without a health
+// check report HealthNone and are treated as healthy while running.
+const (
+	HealthNone      = ""
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 3 * time.Second
+	defaultHealthRetries  = 3
+)
+
+// IsRoutable reports whether a service in health state h may receive
+// traffic.
+func IsRoutable(h string) bool {
+	return h == HealthNone || h == HealthHealthy
+}
+
+func (hc HealthCheck) interval() time.Duration {
+	if hc.IntervalSec > 0 {
+		return time.Duration(hc.IntervalSec) * time.Second
+	}
+	return defaultHealthInterval
+}
+
+func (hc HealthCheck) timeout() time.Duration {
+	if hc.TimeoutSec > 0 {
+		return time.Duration(hc.TimeoutSec) * time.Second
+	}
+	return defaultHealthTimeout
+}
+
+func (hc HealthCheck) retries() int {
+	if hc.Retries > 0 {
+		return hc.Retries
+	}
+	return defaultHealthRetries
+}
+
+// HealthMonitor runs one probe loop per checked service and reports state
+// transitions through onChange.
+type HealthMonitor struct {
+	mu       sync.Mutex
+	backend  ContainerBackend
+	probes   map[string]*healthProbe
+	onChange func(serviceID, status string)
+}
+
+type healthProbe struct {
+	status string
+	cancel context.CancelFunc
+}
+
+func NewHealthMonitor(backend ContainerBackend, onChange func(serviceID, status string)) *HealthMonitor {
+	return &HealthMonitor{
+		backend:  backend,
+		probes:   map[string]*healthProbe{},
+		onChange: onChange,
+	}
+}
+
+// Watch starts probing a service unless it is already being probed.
+func (hm *HealthMonitor) Watch(ctx context.Context, svc Service, check HealthCheck) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	if _, ok := hm.probes[svc.ServiceID]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	hm.probes[svc.ServiceID] = &healthProbe{status: HealthStarting, cancel: cancel}
+	go hm.run(ctx, svc, check)
+}
+
+func (hm *HealthMonitor) Unwatch(serviceID string) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	if p, ok := hm.probes[serviceID]; ok {
+		p.cancel()
+		delete(hm.probes, serviceID)
+	}
+}
+
+// Watched lists the services currently being probed.
+func (hm *HealthMonitor) Watched() []string {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	out := make([]string, 0, len(hm.probes))
+	for id := range hm.probes {
+		out = append(out, id)
+	}
+	return out
+}
+
+func (hm *HealthMonitor) Status(serviceID string) string {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	if p, ok := hm.probes[serviceID]; ok {
+		return p.status
+	}
+	return HealthNone
+}
+
+// run follows Docker's HEALTHCHECK rules: failures during the start period
+// don't count, one success makes the service healthy, and Retries
+// consecutive failures make it unhealthy.
+func (hm *HealthMonitor) run(ctx context.Context, svc Service, check HealthCheck) {
+	startedAt := time.Now()
+	startPeriod := time.Duration(check.StartPeriodSec) * time.Second
+	failures := 0
+
+	ticker := time.NewTicker(check.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := hm.probe(ctx, svc, check)
+		if ctx.Err() != nil {
+			return
+		}
+
+		switch {
+		case err == nil:
+			failures = 0
+			hm.set(ctx, svc.ServiceID, HealthHealthy)
+		case time.Since(startedAt) < startPeriod && hm.Status(svc.ServiceID) == HealthStarting:
+			// still warming up
+		default:
+			failures++
+			if failures >= check.retries() {
+				hm.set(ctx, svc.ServiceID, HealthUnhealthy)
+			}
+		}
+	}
+}
+
+func (hm *HealthMonitor) set(ctx context.Context, serviceID, status string) {
+	hm.mu.Lock()
+	p, ok := hm.probes[serviceID]
+	if !ok || ctx.Err() != nil || p.status == status {
+		hm.mu.Unlock()
+		return
+	}
+	p.status = status
+	hm.mu.Unlock()
+
+	if hm.onChange != nil {
+		hm.onChange(serviceID, status)
+	}
+}
+
+func (hm *HealthMonitor) probe(ctx context.Context, svc Service, check HealthCheck) error {
+	ctx, cancel := context.WithTimeout(ctx, check.timeout())
+	defer cancel()
+
+	addr := net.JoinHostPort("127.0.0.1", svc.HostPort)
+
+	switch {
+	case len(check.Exec) > 0:
+		code, err := hm.backend.ExecContainer(ctx, svc.ServiceID, check.Exec)
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("exit code %d", code)
+		}
+		return nil
+
+	case check.HTTPPath != "":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+check.HTTPPath, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("http status %d", resp.StatusCode)
+		}
+		return nil
+
+	case check.TCP:
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+// ==========================
+// identity.go
+// ==========================
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// identityFileName holds the node's libp2p private key, protobuf-encoded
+// as by crypto.MarshalPrivateKey. Its peer ID is what friends bookmark.
+const identityFileName = "identity.key"
+
+func (sn *ServiceNode) identityPath() string {
+	return filepath.Join(sn.cfg.Dir, identityFileName)
+}
+
+// LoadOrCreateIdentity reads the key at path, generating and saving an
+// Ed25519 key on first use. A key file readable by others is tightened to
+// owner-only.
+func LoadOrCreateIdentity(path string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, _, err := crypto.GenerateEd25519Key(nil)
+		if err != nil {
+			return nil, err
+		}
+		return key, saveIdentity(path, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if st, err := os.Stat(path); err == nil && st.Mode().Perm()&0o077 != 0 {
+		fmt.Println("Tightening permissions on", path)
+		if err := os.Chmod(path, 0o600); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+func saveIdentity(path string, key crypto.PrivKey) error {
+	data, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0o600)
+}
+
+// ErrP2PNotRunning is returned for the peer ID when there is no host.
+var ErrP2PNotRunning = errors.New("P2P is not running")
+
+// PeerID returns the ID the node is running as, which peers see.
+func (sn *ServiceNode) PeerID() (peer.ID, error) {
+	if sn.host == nil {
+		return "", ErrP2PNotRunning
+	}
+	return sn.host.ID(), nil
+}
+
+// PendingPeerID returns the ID of the stored identity when it differs from
+// the running one, i.e. after RotateIdentity or ImportIdentity until the
+// next start. It reads the key without creating one.
+func (sn *ServiceNode) PendingPeerID() (peer.ID, bool, error) {
+	data, err := os.ReadFile(sn.identityPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	key, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return "", false, err
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return "", false, err
+	}
+	if sn.host != nil && id == sn.host.ID() {
+		return "", false, nil
+	}
+	return id, true, nil
+}
+
+// ExportIdentity copies the private key to path, owner-readable only.
+func (sn *ServiceNode) ExportIdentity(path string) error {
+	key, err := LoadOrCreateIdentity(sn.identityPath())
+	if err != nil {
+		return err
+	}
+	return saveIdentity(path, key)
+}
+
+// ImportIdentity replaces the node's key with the one at path. The
+// previous key is kept next to it as identity.key.bak. Like RotateIdentity,
+// it takes effect the next time P2P starts.
+func (sn *ServiceNode) ImportIdentity(path string) (peer.ID, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return "", fmt.Errorf("not a libp2p private key: %w", err)
+	}
+	return sn.replaceIdentity(key)
+}
+
+// RotateIdentity generates a fresh key, giving the node a new peer ID.
+func (sn *ServiceNode) RotateIdentity() (peer.ID, error) {
+	key, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		return "", err
+	}
+	return sn.replaceIdentity(key)
+}
+
+func (sn *ServiceNode) replaceIdentity(key crypto.PrivKey) (peer.ID, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	path := sn.identityPath()
+	if old, err := os.ReadFile(path); err == nil {
+		if err := writeFileAtomic(path+".bak", old, 0o600); err != nil {
+			return "", err
+		}
+	}
+	if err := saveIdentity(path, key); err != nil {
+		return "", err
+	}
+	return id, nil
+}
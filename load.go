@@ -0,0 +1,75 @@
+// ==========================
+// load.go
+// ==========================
+package main
+
+// ServiceLoad is what a node reports about how busy one of its services
+// is. Rates are per minute; pressures are percentages of the container's
+// limits as sampled by the metrics sampler.
+type ServiceLoad struct {
+	InFlight      int64   `json:"inFlight"`
+	RatePerMin    float64 `json:"ratePerMin"`
+	CPUPercent    float64 `json:"cpuPercent"`
+	MemoryPercent float64 `json:"memoryPercent"`
+	Capacity      int     `json:"capacity,omitempty"`
+}
+
+// Score condenses the load into one number where 1 roughly means "fully
+// busy": in-flight requests as a share of capacity (or the raw count when
+// capacity is unlimited) plus the worse of CPU and memory pressure. The
+// request rate only breaks ties between otherwise idle services.
+func (l ServiceLoad) Score() float64 {
+	util := float64(l.InFlight)
+	if l.Capacity > 0 {
+		util /= float64(l.Capacity)
+	}
+	pressure := max(l.CPUPercent, l.MemoryPercent) / 100
+	return util + pressure + l.RatePerMin/1e6
+}
+
+// Saturated reports whether the service is at its declared capacity.
+func (l ServiceLoad) Saturated() bool {
+	return l.Capacity > 0 && l.InFlight >= int64(l.Capacity)
+}
+
+// serviceLoad gathers the live load of a local service.
+func (sn *ServiceNode) serviceLoad(s Service) ServiceLoad {
+	l := ServiceLoad{
+		RatePerMin: sn.stats.Rate(s.ServiceID),
+	}
+	if st, ok := sn.stats.Snapshot()[s.ServiceID]; ok {
+		l.InFlight = st.InFlight
+	}
+	if m, ok := sn.metrics.Latest(s.ServiceID); ok {
+		l.CPUPercent = m.CPUPercent
+		l.MemoryPercent = m.MemoryPercent
+	}
+	if p, ok := sn.config.Get(s.Profile); ok && p.LoadBalancing != nil {
+		l.Capacity = p.LoadBalancing.Capacity
+	}
+	return l
+}
+
+// announcedServices returns the local services with their current load,
+// ready to be published. Services being stopped have been withdrawn
+// already and are left out.
+func (sn *ServiceNode) announcedServices() []Service {
+	sn.mu.Lock()
+	stopping := make(map[string]bool, len(sn.stopping))
+	for id := range sn.stopping {
+		stopping[id] = true
+	}
+	sn.mu.Unlock()
+
+	services := []Service{}
+	for _, s := range sn.ListServices() {
+		if stopping[s.ServiceID] {
+			continue
+		}
+		l := sn.serviceLoad(s)
+		s.Load = &l
+		s.ActiveConns = int(l.InFlight)
+		services = append(services, s)
+	}
+	return services
+}
@@ -0,0 +1,265 @@
+// ==========================
+// logs.go
+// ==========================
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogMaxBytes = 4 << 20
+
+	// maxLogLines bounds how many lines Tail and Search return at once.
+	maxLogLines = 10000
+)
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// LogStore keeps a bounded on-disk history per service as JSON lines. When
+// a service's file passes maxBytes it is rotated to <id>.log.1, replacing
+// the previous rotation, so each service uses at most twice maxBytes.
+type LogStore struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	files    map[string]*os.File
+	sizes    map[string]int64
+	last     map[string]time.Time
+}
+
+func NewLogStore(dir string, maxBytes int64) *LogStore {
+	return &LogStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		files:    map[string]*os.File{},
+		sizes:    map[string]int64{},
+		last:     map[string]time.Time{},
+	}
+}
+
+func (ls *LogStore) path(serviceID string) string {
+	return filepath.Join(ls.dir, unsafeFileChars.ReplaceAllString(serviceID, "_")+".log")
+}
+
+func (ls *LogStore) Append(line LogLine) error {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	f, err := ls.open(line.ServiceID)
+	if err != nil {
+		return err
+	}
+
+	if ls.sizes[line.ServiceID]+int64(len(data)) > ls.maxBytes {
+		if f, err = ls.rotate(line.ServiceID); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.Write(data)
+	ls.sizes[line.ServiceID] += int64(n)
+	if line.Time.After(ls.last[line.ServiceID]) {
+		ls.last[line.ServiceID] = line.Time
+	}
+	return err
+}
+
+func (ls *LogStore) open(serviceID string) (*os.File, error) {
+	if f, ok := ls.files[serviceID]; ok {
+		return f, nil
+	}
+
+	if err := os.MkdirAll(ls.dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(ls.path(serviceID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	ls.files[serviceID] = f
+	ls.sizes[serviceID] = st.Size()
+	return f, nil
+}
+
+func (ls *LogStore) rotate(serviceID string) (*os.File, error) {
+	if f, ok := ls.files[serviceID]; ok {
+		f.Close()
+		delete(ls.files, serviceID)
+	}
+
+	p := ls.path(serviceID)
+	if err := os.Rename(p, p+".1"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return ls.open(serviceID)
+}
+
+// Last returns the timestamp of the newest stored line, so followers can
+// resume without duplicating output.
+func (ls *LogStore) Last(serviceID string) time.Time {
+	ls.mu.Lock()
+	t, ok := ls.last[serviceID]
+	ls.mu.Unlock()
+	if ok {
+		return t
+	}
+
+	lines, _ := ls.Tail(serviceID, 1)
+	if len(lines) > 0 {
+		t = lines[0].Time
+	}
+
+	ls.mu.Lock()
+	if t.After(ls.last[serviceID]) {
+		ls.last[serviceID] = t
+	}
+	ls.mu.Unlock()
+	return t
+}
+
+// Tail returns the newest n lines for a service, oldest first. n is capped
+// at maxLogLines.
+func (ls *LogStore) Tail(serviceID string, n int) ([]LogLine, error) {
+	out := []LogLine{}
+	if n < 1 {
+		return out, nil
+	}
+	n = min(n, maxLogLines)
+	err := ls.scan(serviceID, func(l LogLine) {
+		if len(out) == n {
+			out = append(out[1:], l)
+		} else {
+			out = append(out, l)
+		}
+	})
+	return out, err
+}
+
+// Since returns the oldest n lines newer than since, so a client that
+// follows a service can page through everything it missed. n is capped at
+// maxLogLines.
+func (ls *LogStore) Since(serviceID string, since time.Time, n int) ([]LogLine, error) {
+	out := []LogLine{}
+	if n < 1 {
+		return out, nil
+	}
+	n = min(n, maxLogLines)
+	err := ls.scan(serviceID, func(l LogLine) {
+		if len(out) < n && l.Time.After(since) {
+			out = append(out, l)
+		}
+	})
+	return out, err
+}
+
+// Search returns up to limit lines whose message contains query,
+// case-insensitively, newest last. limit is capped at maxLogLines.
+func (ls *LogStore) Search(serviceID, query string, limit int) ([]LogLine, error) {
+	out := []LogLine{}
+	if limit < 1 {
+		return out, nil
+	}
+	limit = min(limit, maxLogLines)
+	q := strings.ToLower(query)
+	err := ls.scan(serviceID, func(l LogLine) {
+		if !strings.Contains(strings.ToLower(l.Message), q) {
+			return
+		}
+		if len(out) == limit {
+			out = append(out[1:], l)
+		} else {
+			out = append(out, l)
+		}
+	})
+	return out, err
+}
+
+// Export writes a service's full retained history as plain text.
+func (ls *LogStore) Export(serviceID string, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	err := ls.scan(serviceID, func(l LogLine) {
+		fmt.Fprintf(bw, "%s %s %s\n", l.Time.Format(time.RFC3339Nano), l.Stream, l.Message)
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// scan visits the rotated file, then the live one.
+func (ls *LogStore) scan(serviceID string, fn func(LogLine)) error {
+	p := ls.path(serviceID)
+	for _, name := range []string{p + ".1", p} {
+		f, err := os.Open(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64<<10), 1<<20)
+		for sc.Scan() {
+			var l LogLine
+			if json.Unmarshal(sc.Bytes(), &l) == nil {
+				fn(l)
+			}
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release closes a service's file for instances that no longer exist. The
+// history stays on disk, within maxBytes, so it can still be read and
+// exported.
+func (ls *LogStore) Release(serviceID string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if f, ok := ls.files[serviceID]; ok {
+		f.Close()
+		delete(ls.files, serviceID)
+	}
+	delete(ls.sizes, serviceID)
+}
+
+func (ls *LogStore) Close() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for id, f := range ls.files {
+		f.Close()
+		delete(ls.files, id)
+	}
+}
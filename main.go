@@ -3,6 +3,7 @@ package main
 import (
 	"embed"
 	"fmt"
+	"os"
 
 	"github.com/wailsapp/wails/v2"
 	"github.com/wailsapp/wails/v2/pkg/options"
@@ -13,9 +14,39 @@ import (
 var assets embed.FS
 
 func main() {
-	app := NewApp()
+	if len(os.Args) > 1 {
+		switch cmd := os.Args[1]; cmd {
+		case "daemon":
+			if err := runDaemon(os.Args[2:]); err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			return
+		case "help", "-h", "--help":
+			fmt.Print(cliUsage)
+			return
+		default:
+			if _, ok := cliCommands[cmd]; ok {
+				os.Exit(runCLI(cmd, os.Args[2:]))
+			}
+		}
+	}
+
+	cfg, err := LoadNodeConfig()
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		return
+	}
+
+	backend, err := NewContainerBackend(cfg.Backend)
+	if err != nil {
+		fmt.Println("Error starting app:", err)
+		return
+	}
+
+	app := NewApp(NewServiceNode(cfg, backend))
 
-	err := wails.Run(&options.App{
+	err = wails.Run(&options.App{
 		Title:  "undocked",
 		Width:  1024,
 		Height: 768,
@@ -24,6 +55,7 @@ func main() {
 		},
 		BackgroundColour: &options.RGBA{R: 27, G: 38, B: 54, A: 1},
 		OnStartup:        app.Startup,
+		OnShutdown:       app.Shutdown,
 		Bind: []interface{}{
 			app,
 		},
@@ -0,0 +1,247 @@
+// ==========================
+// metrics.go
+// ==========================
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	metricsInterval = 5 * time.Second
+	metricsCapacity = 720 // one hour at the default interval
+)
+
+// MetricSample is one resource reading for a service. Network and block IO
+// are cumulative byte counters since the container started.
+type MetricSample struct {
+	Time            time.Time `json:"time"`
+	CPUPercent      float64   `json:"cpuPercent"`
+	MemoryBytes     uint64    `json:"memoryBytes"`
+	MemoryLimit     uint64    `json:"memoryLimit"`
+	MemoryPercent   float64   `json:"memoryPercent"`
+	NetRxBytes      uint64    `json:"netRxBytes"`
+	NetTxBytes      uint64    `json:"netTxBytes"`
+	BlockReadBytes  uint64    `json:"blockReadBytes"`
+	BlockWriteBytes uint64    `json:"blockWriteBytes"`
+}
+
+// MetricsSummary condenses a service's buffered samples for NodeSnapshot.
+type MetricsSummary struct {
+	Latest          MetricSample `json:"latest"`
+	AvgCPUPercent   float64      `json:"avgCpuPercent"`
+	PeakMemoryBytes uint64       `json:"peakMemoryBytes"`
+	Samples         int          `json:"samples"`
+}
+
+type MetricsSampler struct {
+	mu       sync.RWMutex
+	backend  ContainerBackend
+	interval time.Duration
+	capacity int
+	rings    map[string]*metricRing
+	prev     map[string]ContainerStatsSample
+}
+
+func NewMetricsSampler(backend ContainerBackend, interval time.Duration, capacity int) *MetricsSampler {
+	return &MetricsSampler{
+		backend:  backend,
+		interval: interval,
+		capacity: capacity,
+		rings:    map[string]*metricRing{},
+		prev:     map[string]ContainerStatsSample{},
+	}
+}
+
+// Run samples every undocked container on each tick until ctx is done.
+func (m *MetricsSampler) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.sampleAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *MetricsSampler) sampleAll(ctx context.Context) {
+	listCtx, cancel := context.WithTimeout(ctx, engineTimeout)
+	containers, err := m.backend.ListContainers(listCtx, map[string]string{ServiceLabel: "true"}, false)
+	cancel()
+	if err != nil {
+		return
+	}
+
+	seen := map[string]struct{}{}
+	for _, c := range containers {
+		seen[c.Name] = struct{}{}
+
+		statsCtx, cancel := context.WithTimeout(ctx, engineTimeout)
+		raw, err := m.backend.ContainerStats(statsCtx, c.ID)
+		cancel()
+		if err != nil {
+			continue
+		}
+		m.record(c.Name, raw)
+	}
+
+	// Stopped services don't keep their history around.
+	m.mu.Lock()
+	for id := range m.rings {
+		if _, ok := seen[id]; !ok {
+			delete(m.rings, id)
+			delete(m.prev, id)
+		}
+	}
+	m.mu.Unlock()
+}
+
+func (m *MetricsSampler) record(serviceID string, raw ContainerStatsSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prevCPU, prevSystem := raw.PreCPUUsage, raw.PreSystemCPUUsage
+	if p, ok := m.prev[serviceID]; ok && prevSystem == 0 {
+		prevCPU, prevSystem = p.CPUUsage, p.SystemCPUUsage
+	}
+	m.prev[serviceID] = raw
+
+	s := MetricSample{
+		Time:            raw.Time,
+		CPUPercent:      cpuPercent(raw, prevCPU, prevSystem),
+		MemoryBytes:     raw.MemoryUsage,
+		MemoryLimit:     raw.MemoryLimit,
+		NetRxBytes:      raw.NetRxBytes,
+		NetTxBytes:      raw.NetTxBytes,
+		BlockReadBytes:  raw.BlockReadBytes,
+		BlockWriteBytes: raw.BlockWriteBytes,
+	}
+	if raw.MemoryLimit > 0 {
+		s.MemoryPercent = float64(raw.MemoryUsage) / float64(raw.MemoryLimit) * 100
+	}
+
+	ring, ok := m.rings[serviceID]
+	if !ok {
+		ring = newMetricRing(m.capacity)
+		m.rings[serviceID] = ring
+	}
+	ring.push(s)
+}
+
+// cpuPercent follows `docker stats`: the container's share of host CPU
+// time between two samples, scaled by the number of CPUs.
+func cpuPercent(raw ContainerStatsSample, prevCPU, prevSystem uint64) float64 {
+	if raw.CPUUsage < prevCPU || raw.SystemCPUUsage <= prevSystem {
+		return 0
+	}
+	cpus := raw.OnlineCPUs
+	if cpus == 0 {
+		cpus = 1
+	}
+	cpuDelta := float64(raw.CPUUsage - prevCPU)
+	systemDelta := float64(raw.SystemCPUUsage - prevSystem)
+	return cpuDelta / systemDelta * float64(cpus) * 100
+}
+
+// Samples returns a service's samples newer than window, oldest first. A
+// zero window returns everything buffered.
+func (m *MetricsSampler) Samples(serviceID string, window time.Duration) []MetricSample {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ring, ok := m.rings[serviceID]
+	if !ok {
+		return []MetricSample{}
+	}
+
+	all := ring.list()
+	if window <= 0 {
+		return all
+	}
+
+	cutoff := time.Now().Add(-window)
+	for i, s := range all {
+		if !s.Time.Before(cutoff) {
+			return all[i:]
+		}
+	}
+	return []MetricSample{}
+}
+
+// Latest returns a service's newest sample.
+func (m *MetricsSampler) Latest(serviceID string) (MetricSample, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ring, ok := m.rings[serviceID]
+	if !ok || (ring.next == 0 && !ring.full) {
+		return MetricSample{}, false
+	}
+	return ring.buf[(ring.next+len(ring.buf)-1)%len(ring.buf)], true
+}
+
+func (m *MetricsSampler) Summary() map[string]MetricsSummary {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := make(map[string]MetricsSummary, len(m.rings))
+	for id, ring := range m.rings {
+		samples := ring.list()
+		if len(samples) == 0 {
+			continue
+		}
+
+		sum := MetricsSummary{
+			Latest:  samples[len(samples)-1],
+			Samples: len(samples),
+		}
+		var cpu float64
+		for _, s := range samples {
+			cpu += s.CPUPercent
+			if s.MemoryBytes > sum.PeakMemoryBytes {
+				sum.PeakMemoryBytes = s.MemoryBytes
+			}
+		}
+		sum.AvgCPUPercent = cpu / float64(len(samples))
+		out[id] = sum
+	}
+	return out
+}
+
+// --------------------------
+// Ring buffer
+// --------------------------
+
+type metricRing struct {
+	buf  []MetricSample
+	next int
+	full bool
+}
+
+func newMetricRing(capacity int) *metricRing {
+	return &metricRing{buf: make([]MetricSample, capacity)}
+}
+
+func (r *metricRing) push(s MetricSample) {
+	r.buf[r.next] = s
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *metricRing) list() []MetricSample {
+	if !r.full {
+		return append([]MetricSample(nil), r.buf[:r.next]...)
+	}
+	out := make([]MetricSample, 0, len(r.buf))
+	out = append(out, r.buf[r.next:]...)
+	return append(out, r.buf[:r.next]...)
+}
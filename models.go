@@ -4,20 +4,31 @@
 package main
 
 import (
-	"os/exec"
 	"sync"
 	"time"
 )
 
 type NodeSnapshot struct {
-	Services []Service               `json:"services"`
-	Peers    []PeerInfo              `json:"peers"`
-	Stats    map[string]ServiceStats `json:"stats"`
+	Services []Service                 `json:"services"`
+	Peers    []PeerInfo                `json:"peers"`
+	Stats    map[string]ServiceStats   `json:"stats"`
+	Metrics  map[string]MetricsSummary `json:"metrics"`
 }
 
+// ServiceConfigStore merges three layers of profiles, later ones winning
+// by name: built-ins, drop-in files from profiles.d, and profiles added at
+// runtime. Only the runtime layer is written back to disk.
 type ServiceConfigStore struct {
 	mu       sync.RWMutex
 	profiles map[string]ServiceProfile
+
+	builtin map[string]ServiceProfile
+	dropIns map[string]ServiceProfile
+	user    map[string]ServiceProfile
+
+	path     string
+	skipped  []skippedProfile
+	onChange func()
 }
 
 // --------------------------
@@ -28,12 +39,21 @@ type Service struct {
 	HostPort    string `json:"hostPort"`
 	Status      string `json:"status"`
 	StartedAt   string `json:"startedAt"`
+	Profile     string `json:"profile,omitempty"`
+	Health      string `json:"health,omitempty"`
+	Weight      int    `json:"weight,omitempty"`
+
+	Restarts     int    `json:"restarts"`
+	RestartState string `json:"restartState,omitempty"`
 
 	// NEW
 	Requests    int64 `json:"requests"`
 	Errors      int64 `json:"errors"`
 	Bandwidth   int64 `json:"bandwidth"`
 	ActiveConns int   `json:"activeConns"`
+
+	// Load is filled in when the service is announced to peers.
+	Load *ServiceLoad `json:"load,omitempty"`
 }
 
 type PeerInfo struct {
@@ -43,6 +63,7 @@ type PeerInfo struct {
 }
 
 type ServiceProfile struct {
+	SchemaVersion   int               `json:"schemaVersion,omitempty"`
 	Name            string            `json:"name"`
 	Image           string            `json:"image"`
 	ContainerPort   int               `json:"containerPort"`
@@ -52,13 +73,41 @@ type ServiceProfile struct {
 	ExposeHTTP      bool              `json:"exposeHTTP"`
 	AuthRequired    bool              `json:"authRequired"`
 	RateLimitPerMin int               `json:"rateLimitPerMin"`
+	HealthCheck     *HealthCheck      `json:"healthCheck,omitempty"`
+	RestartPolicy   *RestartPolicy    `json:"restartPolicy,omitempty"`
+	Volumes         []VolumeMount     `json:"volumes,omitempty"`
+	LoadBalancing   *LoadBalancing    `json:"loadBalancing,omitempty"`
+	Groups          []string          `json:"groups,omitempty"`
+}
+
+// VolumeMount declares storage for a profile: a named volume managed by
+// undocked (Name) or a host directory (HostPath), mounted at Target.
+type VolumeMount struct {
+	Name     string `json:"name,omitempty"`
+	HostPath string `json:"hostPath,omitempty"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+// HealthCheck describes how to probe a running instance. Exactly one of
+// HTTPPath, TCP or Exec should be set; HTTP and TCP probes target the
+// published host port. Durations are in seconds.
+type HealthCheck struct {
+	HTTPPath       string   `json:"httpPath,omitempty"`
+	TCP            bool     `json:"tcp,omitempty"`
+	Exec           []string `json:"exec,omitempty"`
+	IntervalSec    int      `json:"intervalSec,omitempty"`
+	TimeoutSec     int      `json:"timeoutSec,omitempty"`
+	Retries        int      `json:"retries,omitempty"`
+	StartPeriodSec int      `json:"startPeriodSec,omitempty"`
 }
 
+// ServiceInstance is one running container started from a profile. Its
+// InstanceID is also the container name and Service.ServiceID.
 type ServiceInstance struct {
-	InstanceID string
-	ProfileID  string
-	Port       int
-	Addr       string
-	Cmd        *exec.Cmd
-	StartedAt  time.Time
+	InstanceID string    `json:"instance_id"`
+	ProfileID  string    `json:"service_id"`
+	Port       int       `json:"port"`
+	Addr       string    `json:"addr"`
+	StartedAt  time.Time `json:"started_at"`
 }
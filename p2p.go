@@ -4,74 +4,521 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"sync"
 	"time"
 
 	libp2p "github.com/libp2p/go-libp2p"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
-	"github.com/wailsapp/wails/v2/pkg/runtime"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
-func (sn *ServiceNode) peerDiscoveryLoop(sub *pubsub.Subscription) {
+// servicesTopic is the GossipSub topic services are announced on. It also
+// names the DHT rendezvous.
+const servicesTopic = "undocked-services"
+
+// gossipChannel is one topic we announce on and listen to: the public
+// topic, or a group's private one. Messages go on name+wireTopicSuffix;
+// the public channel also keeps the pre-envelope JSON topic for older
+// nodes.
+type gossipChannel struct {
+	name   string
+	group  *Group // nil for the public topic
+	topic  *pubsub.Topic
+	sub    *pubsub.Subscription
+	legacy *pubsub.Topic
+	lsub   *pubsub.Subscription
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	announcer announcer
+}
+
+func (ch *gossipChannel) groupName() string {
+	if ch.group == nil {
+		return ""
+	}
+	return ch.group.Name
+}
+
+// joinChannel subscribes to the public topic (g == nil) or a group's.
+func (sn *ServiceNode) joinChannel(g *Group) error {
+	name := servicesTopic
+	if g != nil {
+		name = g.topic()
+	}
+
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	if _, ok := sn.channels[name]; ok {
+		return nil
+	}
+
+	ch := &gossipChannel{name: name, group: g}
+	var err error
+	if ch.topic, ch.sub, err = sn.joinTopic(name+wireTopicSuffix, sn.announcementValidator(ch, false)); err != nil {
+		return err
+	}
+	if g == nil {
+		if ch.legacy, ch.lsub, err = sn.joinTopic(name, sn.announcementValidator(ch, true)); err != nil {
+			sn.closeTopic(ch.topic, ch.sub)
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(sn.ctx)
+	ch.cancel = cancel
+	sn.channels[name] = ch
+
+	go sn.peerDiscoveryLoop(ctx, ch, ch.sub)
+	if ch.lsub != nil {
+		go sn.peerDiscoveryLoop(ctx, ch, ch.lsub)
+	}
+	return nil
+}
+
+func (sn *ServiceNode) joinTopic(name string, validator pubsub.ValidatorEx) (*pubsub.Topic, *pubsub.Subscription, error) {
+	topic, err := sn.ps.Join(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := topic.SetScoreParams(topicScoreParams()); err != nil {
+		topic.Close()
+		return nil, nil, err
+	}
+	if err := sn.ps.RegisterTopicValidator(name, validator); err != nil {
+		topic.Close()
+		return nil, nil, err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		sn.ps.UnregisterTopicValidator(name)
+		topic.Close()
+		return nil, nil, err
+	}
+	return topic, sub, nil
+}
+
+func (sn *ServiceNode) closeTopic(topic *pubsub.Topic, sub *pubsub.Subscription) {
+	sub.Cancel()
+	sn.ps.UnregisterTopicValidator(topic.String())
+	topic.Close()
+}
+
+func (sn *ServiceNode) leaveChannel(name string) {
+	sn.mu.Lock()
+	ch, ok := sn.channels[name]
+	delete(sn.channels, name)
+	for id, views := range sn.peerViews {
+		if _, ok := views[name]; ok {
+			delete(views, name)
+			sn.mergePeerViews(id, sn.peers[id].LastSeen)
+		}
+	}
+	sn.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	ch.cancel()
+	sn.closeTopic(ch.topic, ch.sub)
+	if ch.legacy != nil {
+		sn.closeTopic(ch.legacy, ch.lsub)
+	}
+	sn.registry.RemoveSource(name)
+}
+
+func (sn *ServiceNode) channelList() []*gossipChannel {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	out := make([]*gossipChannel, 0, len(sn.channels))
+	for _, ch := range sn.channels {
+		out = append(out, ch)
+	}
+	return out
+}
+
+func (sn *ServiceNode) peerDiscoveryLoop(ctx context.Context, ch *gossipChannel, sub *pubsub.Subscription) {
 	for {
-		msg, err := sub.Next(sn.ctx)
+		msg, err := sub.Next(ctx)
 		if err != nil {
 			return
 		}
 
-		var info PeerInfo
-		if err := json.Unmarshal(msg.Data, &info); err != nil {
+		// announcementValidator has checked and decoded it, including that
+		// it comes from the peer that signed it.
+		m, ok := msg.ValidatorData.(wireMessage)
+		if !ok {
 			continue
 		}
 
-		sn.mu.Lock()
-		sn.peers[info.ID] = &info
+		// Our own messages come back to us, and current nodes send JSON
+		// copies for older ones that we get the envelope for anyway.
+		id := msg.GetFrom()
+		if id == sn.host.ID() || m.compat {
+			continue
+		}
+
+		if m.Goodbye {
+			sn.forgetPeer(m.PeerID)
+			continue
+		}
+		if m.Resync {
+			ch.mu.Lock()
+			ch.announcer.wantFull = true
+			ch.mu.Unlock()
+		}
+
+		services, ok := sn.updatePeer(ch, m)
+		if ok {
+			sn.registry.UpdatePeer(id, ch.name, services)
+		}
+	}
+}
+
+// updatePeer applies a message from a peer to its view of one channel and
+// returns the services it now has there. sn.peers holds the union over
+// every channel we share with it. A heartbeat from a peer we hold no view
+// for is ignored, so a late one can't bring back a peer that said goodbye.
+func (sn *ServiceNode) updatePeer(ch *gossipChannel, m wireMessage) ([]Service, bool) {
+	// Expiry runs on our clock, not the sender's.
+	now := time.Now()
+
+	sn.mu.Lock()
+	if m.legacy {
+		sn.legacySeen = now
+	}
+	views, known := sn.peerViews[m.PeerID]
+	view, ok := views[ch.name]
+	if !ok && m.Type == wireHeartbeat {
 		sn.mu.Unlock()
+		return nil, false
+	}
+	if !known {
+		views = map[string]*peerView{}
+		sn.peerViews[m.PeerID] = views
+	}
+	if !ok {
+		view = &peerView{}
+		views[ch.name] = view
+	}
+	gap := view.apply(m)
+	services := view.services
+	merged := sn.mergePeerViews(m.PeerID, now.Format(time.RFC3339))
+	sn.mu.Unlock()
+
+	// Someone new on the channel: send them everything next time rather
+	// than make them wait for the next full announcement. If we missed
+	// some of theirs, ask for the same.
+	if !ok || gap {
+		ch.mu.Lock()
+		ch.announcer.wantFull = ch.announcer.wantFull || !ok
+		ch.announcer.resync = ch.announcer.resync || gap
+		ch.mu.Unlock()
+	}
 
-		runtime.EventsEmit(sn.ctx, "peer-update", info)
+	if !known {
+		sn.emit("peer-joined", merged)
 	}
+	sn.emit("peer-update", merged)
+	return services, true
 }
 
-func (sn *ServiceNode) InitP2P() error {
-	h, err := libp2p.New()
-	if err != nil {
-		return err
+// mergePeerViews rebuilds sn.peers[id] from its per-channel views.
+// Callers hold sn.mu.
+func (sn *ServiceNode) mergePeerViews(id, lastSeen string) PeerInfo {
+	merged := PeerInfo{ID: id, LastSeen: lastSeen, Services: []Service{}}
+	seen := map[string]bool{}
+	for _, v := range sn.peerViews[id] {
+		for _, s := range v.services {
+			if !seen[s.ServiceID] {
+				seen[s.ServiceID] = true
+				merged.Services = append(merged.Services, s)
+			}
+		}
+	}
+	sn.peers[id] = &merged
+	return merged
+}
+
+// heartbeatLoop re-announces our services every heartbeat, so peers keep
+// us alive and see fresh load, and drops peers that have gone quiet.
+func (sn *ServiceNode) heartbeatLoop() {
+	ticker := time.NewTicker(sn.cfg.heartbeat())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sn.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		sn.BroadcastServices()
+		sn.expirePeers(time.Now().Add(-sn.cfg.peerTTL()))
+	}
+}
+
+func (sn *ServiceNode) expirePeers(cutoff time.Time) {
+	var gone []PeerInfo
+
+	sn.mu.Lock()
+	for id, info := range sn.peers {
+		seen, err := time.Parse(time.RFC3339, info.LastSeen)
+		if err == nil && !seen.Before(cutoff) {
+			continue
+		}
+		delete(sn.peers, id)
+		delete(sn.peerViews, id)
+		gone = append(gone, *info)
 	}
+	sn.mu.Unlock()
 
-	ps, err := pubsub.NewGossipSub(sn.ctx, h)
+	for _, info := range gone {
+		sn.dropPeer(info)
+	}
+}
+
+// forgetPeer removes a peer that said goodbye from sn.peers, then drops it.
+func (sn *ServiceNode) forgetPeer(id string) {
+	sn.mu.Lock()
+	info, ok := sn.peers[id]
+	delete(sn.peers, id)
+	delete(sn.peerViews, id)
+	sn.mu.Unlock()
+
+	if ok {
+		sn.dropPeer(*info)
+	}
+}
+
+// dropPeer forgets a peer's services and tells the UI it left. Callers
+// have already removed it from sn.peers.
+func (sn *ServiceNode) dropPeer(info PeerInfo) {
+	if id, err := peer.Decode(info.ID); err == nil {
+		sn.registry.RemovePeer(id)
+	}
+	sn.emit("peer-left", info)
+}
+
+func (sn *ServiceNode) InitP2P() error {
+	key, err := LoadOrCreateIdentity(sn.identityPath())
 	if err != nil {
 		return err
 	}
 
-	topic, err := ps.Join("undocked-services")
+	// One host carries both gossip and routed requests, so the peer ID we
+	// announce is the one peers forward to. Local-only nodes don't reach
+	// past the LAN.
+	opts := []libp2p.Option{libp2p.Identity(key)}
+	if !sn.cfg.LocalOnly {
+		opts = append(opts,
+			libp2p.EnableRelay(),
+			libp2p.EnableNATService(),
+			libp2p.NATPortMap(),
+		)
+		if sn.cfg.RelayService {
+			opts = append(opts, libp2p.EnableRelayService())
+		}
+	}
+	h, err := libp2p.New(opts...)
 	if err != nil {
 		return err
 	}
 
-	sub, err := topic.Subscribe()
+	ps, err := pubsub.NewGossipSub(sn.ctx, h,
+		pubsub.WithMessageSignaturePolicy(pubsub.StrictSign),
+		announcementScoring(),
+	)
 	if err != nil {
 		return err
 	}
 
 	sn.host = h
 	sn.ps = ps
-	sn.topic = topic
 
-	go sn.peerDiscoveryLoop(sub)
+	if err := sn.joinChannel(nil); err != nil {
+		return err
+	}
+	sn.mu.Lock()
+	groups := make([]Group, 0, len(sn.groups))
+	for _, g := range sn.groups {
+		groups = append(groups, g)
+	}
+	sn.mu.Unlock()
+	for i := range groups {
+		if err := sn.joinChannel(&groups[i]); err != nil {
+			fmt.Printf("Joining group %s: %v\n", groups[i].Name, err)
+		}
+	}
+
+	go sn.heartbeatLoop()
+
+	// The DHT goes first: mDNS and invite callbacks read sn.dht from
+	// their own goroutines, so it must be set before any can run.
+	if sn.cfg.DHT && !sn.cfg.LocalOnly {
+		if err := sn.startDHT(); err != nil {
+			fmt.Println("DHT discovery disabled:", err)
+		}
+	}
+	if sn.cfg.MDNS {
+		if err := sn.startMDNS(); err != nil {
+			fmt.Println("mDNS discovery disabled:", err)
+		}
+	}
 	return nil
 }
 
+// BroadcastServices announces our services on every channel. Services
+// whose profile is limited to certain groups are only announced there.
 func (sn *ServiceNode) BroadcastServices() {
-	if sn.topic == nil || sn.host == nil {
+	if sn.host == nil {
+		return
+	}
+
+	self := sn.host.ID()
+	now := time.Now()
+	all := sn.announcedServices()
+
+	for _, ch := range sn.channelList() {
+		services := []Service{}
+		for _, s := range all {
+			if sn.visibleIn(s, ch.groupName()) {
+				services = append(services, s)
+			}
+		}
+		// Publish under the lock so messages leave in sequence order, and
+		// never after our goodbye.
+		ch.mu.Lock()
+		if ch.announcer.closed {
+			ch.mu.Unlock()
+			continue
+		}
+		sn.registry.UpdatePeer(self, ch.name, services)
+		m := ch.announcer.next(self.String(), services, now)
+		sn.publish(ch, m.marshal())
+		ch.mu.Unlock()
+
+		if sn.legacyPeers(ch, now) {
+			sn.publishLegacy(ch, services, now)
+		}
+	}
+}
+
+// WithdrawServices tells peers right away that services are going away,
+// so they stop routing to them before the containers are gone.
+func (sn *ServiceNode) WithdrawServices(ids ...string) {
+	if sn.host == nil {
 		return
 	}
 
-	info := PeerInfo{
-		ID:       sn.host.ID().String(),
-		Services: sn.ListServices(),
-		LastSeen: time.Now().Format(time.RFC3339),
+	self := sn.host.ID()
+	now := time.Now()
+	sn.registry.RemoveServices(self, ids)
+
+	var remaining []Service
+	for _, ch := range sn.channelList() {
+		ch.mu.Lock()
+		if m, ok := ch.announcer.withdraw(self.String(), ids, false, now); ok {
+			sn.publish(ch, m.marshal())
+		}
+		ch.mu.Unlock()
+
+		if sn.legacyPeers(ch, now) {
+			if remaining == nil {
+				remaining = sn.announcedServices()
+			}
+			services := []Service{}
+			for _, s := range remaining {
+				if sn.visibleIn(s, ch.groupName()) {
+					services = append(services, s)
+				}
+			}
+			sn.publishLegacy(ch, services, now)
+		}
 	}
+}
 
-	data, _ := json.Marshal(info)
-	_ = sn.topic.Publish(sn.ctx, data)
+// goodbyeGrace gives the goodbye messages time to leave before the host
+// shuts down; pubsub has no flush.
+const goodbyeGrace = 500 * time.Millisecond
+
+// sayGoodbye tells every topic we are shutting down, so peers drop us now
+// rather than when we expire.
+func (sn *ServiceNode) sayGoodbye() {
+	if sn.host == nil {
+		return
+	}
+
+	self := sn.host.ID()
+	now := time.Now()
+
+	sent := false
+	for _, ch := range sn.channelList() {
+		ch.mu.Lock()
+		if m, ok := ch.announcer.withdraw(self.String(), nil, true, now); ok {
+			sn.publish(ch, m.marshal())
+			sent = true
+		}
+		ch.mu.Unlock()
+
+		// Older nodes have no goodbye; an empty list at least stops them
+		// routing to us.
+		if sn.legacyPeers(ch, now) {
+			sn.publishLegacy(ch, []Service{}, now)
+		}
+	}
+	if sent {
+		time.Sleep(goodbyeGrace)
+	}
+}
+
+// legacyPeers reports whether a node from before the envelope is on ch:
+// subscribed to its JSON topic but not the envelope one, or heard from
+// recently. Those nodes only publish when they start and stop, so an
+// idle one is only visible through its subscription.
+func (sn *ServiceNode) legacyPeers(ch *gossipChannel, now time.Time) bool {
+	if ch.legacy == nil {
+		return false
+	}
+
+	current := map[peer.ID]bool{}
+	for _, p := range ch.topic.ListPeers() {
+		current[p] = true
+	}
+	for _, p := range ch.legacy.ListPeers() {
+		if !current[p] {
+			return true
+		}
+	}
+
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	return now.Sub(sn.legacySeen) < sn.cfg.peerTTL()
+}
+
+// publishLegacy sends services as pre-envelope JSON. Those nodes only read
+// it on the public topic.
+func (sn *ServiceNode) publishLegacy(ch *gossipChannel, services []Service, now time.Time) {
+	if ch.legacy == nil {
+		return
+	}
+	data, _ := json.Marshal(legacyAnnouncement{
+		PeerInfo: PeerInfo{ID: sn.host.ID().String(), Services: services, LastSeen: now.Format(time.RFC3339)},
+		Wire:     wireVersion,
+	})
+	_ = ch.legacy.Publish(sn.ctx, data)
+}
+
+// publish sends data on ch, sealed with the group key for groups.
+func (sn *ServiceNode) publish(ch *gossipChannel, data []byte) {
+	if ch.group != nil {
+		var err error
+		if data, err = ch.group.seal(data); err != nil {
+			return
+		}
+	}
+	_ = ch.topic.Publish(sn.ctx, data)
 }
@@ -5,43 +5,205 @@ package main
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
+var ErrNoEndpoints = errors.New("no services available")
+
+// ServiceEndpoint is one running service on one peer that the router may
+// forward to. Profile is the service type requests are matched on; Load is
+// the announced ServiceLoad.Score.
 type ServiceEndpoint struct {
 	ServiceID string
+	Profile   string
 	PeerID    peer.ID
-	Load      int64
+	Load      float64
+	Weight    int
+	Health    string
+	Saturated bool
 }
 
+// PeerRegistry holds the routable endpoints each peer last announced on
+// each gossip topic, and balances requests over them with each profile's
+// configured strategy.
 type PeerRegistry struct {
-	mu       sync.RWMutex
-	services []ServiceEndpoint
+	mu        sync.RWMutex
+	peers     map[peer.ID]map[string][]ServiceEndpoint // peer -> topic -> endpoints
+	config    *ServiceConfigStore
+	balancers map[string]profileBalancer
+}
+
+type profileBalancer struct {
+	strategy string
+	Balancer
 }
 
-func NewPeerRegistry() *PeerRegistry {
-	return &PeerRegistry{}
+func NewPeerRegistry(config *ServiceConfigStore) *PeerRegistry {
+	return &PeerRegistry{
+		peers:     map[peer.ID]map[string][]ServiceEndpoint{},
+		config:    config,
+		balancers: map[string]profileBalancer{},
+	}
 }
 
-func (pr *PeerRegistry) Update(s []ServiceEndpoint) {
+// UpdatePeer replaces what a peer announced on source with its latest
+// announcement. Only running services started from a profile are kept;
+// anything else can't be matched to a request.
+func (pr *PeerRegistry) UpdatePeer(id peer.ID, source string, services []Service) {
+	endpoints := make([]ServiceEndpoint, 0, len(services))
+	for _, s := range services {
+		if s.Status != "running" || s.Profile == "" {
+			continue
+		}
+		e := ServiceEndpoint{
+			ServiceID: s.ServiceID,
+			Profile:   s.Profile,
+			PeerID:    id,
+			Load:      float64(s.ActiveConns),
+			Weight:    s.Weight,
+			Health:    s.Health,
+		}
+		if s.Load != nil {
+			e.Load = s.Load.Score()
+			e.Saturated = s.Load.Saturated()
+		}
+		endpoints = append(endpoints, e)
+	}
+
 	pr.mu.Lock()
-	pr.services = s
+	defer pr.mu.Unlock()
+	sources := pr.peers[id]
+	if len(endpoints) == 0 {
+		delete(sources, source)
+		if len(sources) == 0 {
+			delete(pr.peers, id)
+		}
+		return
+	}
+	if sources == nil {
+		sources = map[string][]ServiceEndpoint{}
+		pr.peers[id] = sources
+	}
+	sources[source] = endpoints
+}
+
+func (pr *PeerRegistry) RemovePeer(id peer.ID) {
+	pr.mu.Lock()
+	delete(pr.peers, id)
 	pr.mu.Unlock()
 }
 
-func (pr *PeerRegistry) SelectLeastLoaded() (ServiceEndpoint, error) {
+// RemoveServices drops a peer's withdrawn services from every topic.
+func (pr *PeerRegistry) RemoveServices(id peer.ID, serviceIDs []string) {
+	gone := make(map[string]bool, len(serviceIDs))
+	for _, s := range serviceIDs {
+		gone[s] = true
+	}
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	for source, endpoints := range pr.peers[id] {
+		kept := endpoints[:0:0]
+		for _, e := range endpoints {
+			if !gone[e.ServiceID] {
+				kept = append(kept, e)
+			}
+		}
+		pr.peers[id][source] = kept
+	}
+}
+
+// RemoveSource forgets everything announced on source, e.g. a group we
+// left.
+func (pr *PeerRegistry) RemoveSource(source string) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	for id, sources := range pr.peers {
+		delete(sources, source)
+		if len(sources) == 0 {
+			delete(pr.peers, id)
+		}
+	}
+}
+
+// Endpoints returns the routable endpoints running profile, sorted by
+// peer and service ID. Endpoints at capacity are left out unless every
+// endpoint is.
+func (pr *PeerRegistry) Endpoints(profile string) []ServiceEndpoint {
 	pr.mu.RLock()
 	defer pr.mu.RUnlock()
-	if len(pr.services) == 0 {
-		return ServiceEndpoint{}, errors.New("no services available")
-	}
-	min := pr.services[0]
-	for _, s := range pr.services {
-		if s.Load < min.Load {
-			min = s
+
+	// A service announced on several topics is still one endpoint.
+	seen := map[string]bool{}
+	var out, saturated []ServiceEndpoint
+	for _, sources := range pr.peers {
+		for _, endpoints := range sources {
+			for _, e := range endpoints {
+				if seen[endpointKey(e)] {
+					continue
+				}
+				seen[endpointKey(e)] = true
+				switch {
+				case e.Profile != profile || !IsRoutable(e.Health):
+				case e.Saturated:
+					saturated = append(saturated, e)
+				default:
+					out = append(out, e)
+				}
+			}
 		}
 	}
-	return min, nil
+	if len(out) == 0 {
+		out = saturated
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return endpointKey(out[i]) < endpointKey(out[j])
+	})
+	return out
+}
+
+// LoadBalancing returns profile's balancing config. Profiles this node
+// doesn't know use the defaults.
+func (pr *PeerRegistry) LoadBalancing(profile string) LoadBalancing {
+	if p, ok := pr.config.Get(profile); ok && p.LoadBalancing != nil {
+		return *p.LoadBalancing
+	}
+	return LoadBalancing{}
+}
+
+// Select picks an endpoint running profile for a request identified by
+// key, which only consistent hashing looks at.
+func (pr *PeerRegistry) Select(profile, key string) (ServiceEndpoint, error) {
+	endpoints := pr.Endpoints(profile)
+	if len(endpoints) == 0 {
+		return ServiceEndpoint{}, ErrNoEndpoints
+	}
+	return pr.balancer(profile).Pick(endpoints, key), nil
+}
+
+// Observe feeds a request's outcome to the profile's balancer.
+func (pr *PeerRegistry) Observe(e ServiceEndpoint, d time.Duration, err error) {
+	if o, ok := pr.balancer(e.Profile).Balancer.(latencyObserver); ok {
+		o.Observe(e, d, err)
+	}
+}
+
+// balancer returns the profile's balancer, replacing it when the profile's
+// strategy has changed.
+func (pr *PeerRegistry) balancer(profile string) profileBalancer {
+	strategy := pr.LoadBalancing(profile).strategy()
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	b, ok := pr.balancers[profile]
+	if !ok || b.strategy != strategy {
+		b = profileBalancer{strategy: strategy, Balancer: NewBalancer(strategy)}
+		pr.balancers[profile] = b
+	}
+	return b
 }
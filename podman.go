@@ -0,0 +1,31 @@
+// ==========================
+// podman.go
+// ==========================
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// NewPodmanRuntime connects to the Podman API socket, which speaks the
+// Docker-compatible Engine API. CONTAINER_HOST wins; otherwise the rootless
+// socket under XDG_RUNTIME_DIR is preferred over the rootful one.
+func NewPodmanRuntime() (*ContainerRuntime, error) {
+	if h := os.Getenv("CONTAINER_HOST"); h != "" {
+		return NewContainerRuntime(BackendPodman, h)
+	}
+
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = filepath.Join("/run/user", strconv.Itoa(os.Getuid()))
+	}
+
+	candidates := []string{
+		filepath.Join(runtimeDir, "podman", "podman.sock"),
+		"/run/podman/podman.sock",
+	}
+
+	return NewContainerRuntime(BackendPodman, "unix://"+firstExisting(candidates))
+}
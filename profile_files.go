@@ -0,0 +1,186 @@
+// ==========================
+// profile_files.go
+// ==========================
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const profileDirPollInterval = 2 * time.Second
+
+// ParseProfiles decodes a profile file holding either a single profile or
+// a list of them. YAML uses the same keys as JSON. Every profile is
+// migrated to the current schema version and validated.
+func ParseProfiles(data []byte, ext string) ([]ServiceProfile, error) {
+	var doc any
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	case ".json":
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported profile file type %q", ext)
+	}
+
+	// Round-trip through JSON so YAML and JSON documents have the same
+	// shape (numbers as float64, string-keyed maps).
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var raws []map[string]any
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		if err := json.Unmarshal(data, &raws); err != nil {
+			return nil, err
+		}
+	} else {
+		var raw map[string]any
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+		raws = []map[string]any{raw}
+	}
+
+	profiles := make([]ServiceProfile, 0, len(raws))
+	for i, raw := range raws {
+		p, err := DecodeProfile(raw)
+		if err != nil {
+			if len(raws) > 1 {
+				return nil, fmt.Errorf("profile %d: %w", i, err)
+			}
+			return nil, err
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+func isProfileFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// LoadProfileDir reads every profile file in dir, in name order so later
+// files win on duplicate names. Files that fail to parse are skipped and
+// reported in errs. A missing directory is not an error.
+func LoadProfileDir(dir string) (profiles []ServiceProfile, errs map[string]error) {
+	errs = map[string]error{}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errs
+	}
+	if err != nil {
+		errs[dir] = err
+		return nil, errs
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	for _, e := range entries {
+		if e.IsDir() || !isProfileFile(e.Name()) {
+			continue
+		}
+
+		path := filepath.Join(dir, e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs[path] = err
+			continue
+		}
+
+		ps, err := ParseProfiles(data, filepath.Ext(path))
+		if err != nil {
+			errs[path] = err
+			continue
+		}
+		profiles = append(profiles, ps...)
+	}
+
+	return profiles, errs
+}
+
+// profileDirSignature changes whenever a profile file in dir is added,
+// removed or modified.
+func profileDirSignature(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, e := range entries {
+		if e.IsDir() || !isProfileFile(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", e.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String()
+}
+
+// --------------------------
+// ServiceNode wiring
+// --------------------------
+
+// reloadProfileDir replaces the drop-in layer with what's on disk now.
+func (sn *ServiceNode) reloadProfileDir() {
+	profiles, errs := LoadProfileDir(sn.profilesDir)
+	for path, err := range errs {
+		fmt.Println("Skipping profile file", path+":", err)
+	}
+	sn.config.SetDropIns(profiles)
+}
+
+// WatchProfileDir polls profiles.d and hot-reloads it on change.
+func (sn *ServiceNode) WatchProfileDir() {
+	go func() {
+		last := profileDirSignature(sn.profilesDir)
+
+		ticker := time.NewTicker(profileDirPollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-sn.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			sig := profileDirSignature(sn.profilesDir)
+			if sig == last {
+				continue
+			}
+			last = sig
+			sn.reloadProfileDir()
+		}
+	}()
+}
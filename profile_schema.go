@@ -0,0 +1,382 @@
+// ==========================
+// profile_schema.go
+// ==========================
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ProfileSchemaVersion is the profile format this build writes. Documents
+// without a schemaVersion are version 1 and are migrated on load.
+const ProfileSchemaVersion = 2
+
+// ProfileSchema is the JSON Schema for the current profile version, served
+// at /v1/services/schema.
+//
+//go:embed profiles/schema.json
+var ProfileSchema []byte
+
+var (
+	profileNamePattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 _.-]{0,63}$`)
+	containerNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	imageRefPattern      = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(:[0-9]+)?(/[a-z0-9]+([._-]+[a-z0-9]+)*)*(:[A-Za-z0-9_][A-Za-z0-9_.-]{0,127})?(@sha256:[a-f0-9]{64})?$`)
+)
+
+// FieldError is one problem with one field, addressed by its JSON path
+// (e.g. "volumes[0].target").
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects every FieldError found in a profile.
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		parts = append(parts, fe.Field+": "+fe.Message)
+	}
+	return "invalid profile: " + strings.Join(parts, "; ")
+}
+
+func (e *ValidationError) add(field, format string, args ...any) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e *ValidationError) err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// --------------------------
+// Decoding and migration
+// --------------------------
+
+// DecodeProfile migrates a raw profile document to the current schema
+// version, decodes it and validates the result. Like the schema, it
+// rejects fields it doesn't know and values of the wrong type.
+func DecodeProfile(raw map[string]any) (ServiceProfile, error) {
+	if err := MigrateProfile(raw); err != nil {
+		return ServiceProfile{}, err
+	}
+
+	var ve ValidationError
+	unknownFields(raw, reflect.TypeOf(ServiceProfile{}), "", &ve)
+	if err := ve.err(); err != nil {
+		return ServiceProfile{}, err
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return ServiceProfile{}, err
+	}
+
+	var p ServiceProfile
+	if err := json.Unmarshal(data, &p); err != nil {
+		var te *json.UnmarshalTypeError
+		if errors.As(err, &te) {
+			ve.add(te.Field, "must be %s", jsonTypeName(te.Type))
+			return ServiceProfile{}, &ve
+		}
+		return ServiceProfile{}, err
+	}
+	return p, ValidateProfile(p)
+}
+
+// jsonTypeName describes t the way the schema does.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	default:
+		return "an object"
+	}
+}
+
+// unknownFields reports keys of v that t has no JSON field for, recursing
+// into nested objects and lists of objects.
+func unknownFields(v any, t reflect.Type, field string, ve *ValidationError) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Slice:
+		if list, ok := v.([]any); ok {
+			for i, item := range list {
+				unknownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", field, i), ve)
+			}
+		}
+	case reflect.Struct:
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return
+		}
+		known := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			if name != "" && name != "-" {
+				known[name] = t.Field(i).Type
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			path := k
+			if field != "" {
+				path = field + "." + k
+			}
+			ft, ok := known[k]
+			if !ok {
+				ve.add(path, "unknown field")
+				continue
+			}
+			unknownFields(obj[k], ft, path, ve)
+		}
+	}
+}
+
+// profileMigrations[v] upgrades a raw document from version v to v+1.
+var profileMigrations = map[int]func(map[string]any){
+	1: migrateProfileV1,
+}
+
+// MigrateProfile upgrades raw in place to ProfileSchemaVersion. Documents
+// without a schemaVersion are version 1.
+func MigrateProfile(raw map[string]any) error {
+	v := 1
+	if n, ok := raw["schemaVersion"]; ok {
+		f, isNum := n.(float64)
+		if !isNum || f != float64(int(f)) || f < 1 {
+			return &ValidationError{Errors: []FieldError{{
+				Field:   "schemaVersion",
+				Message: fmt.Sprintf("must be an integer between 1 and %d", ProfileSchemaVersion),
+			}}}
+		}
+		v = int(f)
+	}
+	if v > ProfileSchemaVersion {
+		return &ValidationError{Errors: []FieldError{{
+			Field:   "schemaVersion",
+			Message: fmt.Sprintf("version %d is newer than this build supports (%d)", v, ProfileSchemaVersion),
+		}}}
+	}
+
+	for ; v < ProfileSchemaVersion; v++ {
+		profileMigrations[v](raw)
+	}
+	raw["schemaVersion"] = ProfileSchemaVersion
+	return nil
+}
+
+// migrateProfileV1 coerces env values to strings. Version 1 files were
+// decoded leniently, so unquoted YAML like `PORT: 5000` was common.
+func migrateProfileV1(raw map[string]any) {
+	env, ok := raw["env"].(map[string]any)
+	if !ok {
+		return
+	}
+	for k, v := range env {
+		switch v := v.(type) {
+		case string:
+		case nil:
+			env[k] = ""
+		case float64:
+			env[k] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			env[k] = fmt.Sprint(v)
+		}
+	}
+}
+
+// --------------------------
+// Validation
+// --------------------------
+
+// ValidateProfile checks p against the current schema. Documents get a
+// SchemaVersion from MigrateProfile; the zero value only occurs for
+// profiles built in Go, which are current by construction.
+func ValidateProfile(p ServiceProfile) error {
+	var ve ValidationError
+
+	if p.SchemaVersion < 0 || p.SchemaVersion > ProfileSchemaVersion {
+		ve.add("schemaVersion", "must be between 1 and %d", ProfileSchemaVersion)
+	}
+
+	if !profileNamePattern.MatchString(p.Name) {
+		ve.add("name", "must be 1-64 letters, digits, spaces, '.', '_' or '-', starting with a letter or digit")
+	}
+
+	if err := validateImageRef(p.Image); err != "" {
+		ve.add("image", "%s", err)
+	}
+
+	if p.ContainerPort < 1 || p.ContainerPort > 65535 {
+		ve.add("containerPort", "must be between 1 and 65535")
+	}
+
+	for k := range p.Env {
+		if k == "" || strings.Contains(k, "=") {
+			ve.add("env."+k, "variable names must be non-empty and must not contain '='")
+		}
+	}
+
+	if p.RateLimitPerMin < 0 {
+		ve.add("rateLimitPerMin", "must not be negative")
+	}
+
+	if hc := p.HealthCheck; hc != nil {
+		kinds := 0
+		if hc.HTTPPath != "" {
+			kinds++
+			if !strings.HasPrefix(hc.HTTPPath, "/") {
+				ve.add("healthCheck.httpPath", "must start with '/'")
+			}
+		}
+		if hc.TCP {
+			kinds++
+		}
+		if len(hc.Exec) > 0 {
+			kinds++
+		}
+		if kinds != 1 {
+			ve.add("healthCheck", "set exactly one of httpPath, tcp or exec")
+		}
+		for field, v := range map[string]int{
+			"intervalSec":    hc.IntervalSec,
+			"timeoutSec":     hc.TimeoutSec,
+			"retries":        hc.Retries,
+			"startPeriodSec": hc.StartPeriodSec,
+		} {
+			if v < 0 {
+				ve.add("healthCheck."+field, "must not be negative")
+			}
+		}
+	}
+
+	if rp := p.RestartPolicy; rp != nil {
+		switch rp.Mode {
+		case RestartNever, RestartOnFailure, RestartAlways:
+		default:
+			ve.add("restartPolicy.mode", "must be one of never, on-failure, always")
+		}
+		if rp.MaxRetries < 0 {
+			ve.add("restartPolicy.maxRetries", "must not be negative")
+		}
+		if rp.MaxRetries > 0 && rp.Mode != RestartOnFailure {
+			ve.add("restartPolicy.maxRetries", "only applies to on-failure")
+		}
+	}
+
+	if lb := p.LoadBalancing; lb != nil {
+		if !validStrategy(lb.Strategy) {
+			ve.add("loadBalancing.strategy", "must be one of least-loaded, round-robin, weighted, p2c, latency-ewma, consistent-hash")
+		}
+		switch {
+		case lb.HashKey == "", lb.HashKey == HashKeyClient, lb.HashKey == HashKeyPath:
+		case strings.HasPrefix(lb.HashKey, "header:") && len(lb.HashKey) > len("header:"):
+		default:
+			ve.add("loadBalancing.hashKey", "must be client, path or header:<Name>")
+		}
+		if lb.Weight < 0 {
+			ve.add("loadBalancing.weight", "must not be negative")
+		}
+		if lb.Capacity < 0 {
+			ve.add("loadBalancing.capacity", "must not be negative")
+		}
+	}
+
+	for i, g := range p.Groups {
+		if !profileNamePattern.MatchString(g) {
+			ve.add(fmt.Sprintf("groups[%d]", i), "must be a group name")
+		}
+	}
+
+	targets := map[string]bool{}
+	for i, v := range p.Volumes {
+		field := fmt.Sprintf("volumes[%d]", i)
+		switch {
+		case v.Name != "" && v.HostPath != "":
+			ve.add(field, "set either name or hostPath, not both")
+		case v.Name == "" && v.HostPath == "":
+			ve.add(field, "set name or hostPath")
+		case v.Name != "" && !containerNamePattern.MatchString(v.Name):
+			ve.add(field+".name", "must be letters, digits, '.', '_' or '-'")
+		case v.HostPath != "" && !strings.HasPrefix(v.HostPath, "/") && !strings.HasPrefix(v.HostPath, "~"):
+			ve.add(field+".hostPath", "must be an absolute path")
+		}
+		if !strings.HasPrefix(v.Target, "/") {
+			ve.add(field+".target", "must be an absolute path")
+		} else if t := path.Clean(v.Target); targets[t] {
+			ve.add(field+".target", "%s is mounted more than once", t)
+		} else {
+			targets[t] = true
+		}
+	}
+
+	return ve.err()
+}
+
+// validateImageRef returns why ref isn't a usable image reference, or "".
+func validateImageRef(ref string) string {
+	switch {
+	case ref == "":
+		return "is required"
+	case strings.ContainsAny(ref, " \t\r\n"):
+		return "must not contain whitespace"
+	}
+
+	// The registry host may contain upper case; the rest may not.
+	name := ref
+	if i := strings.Index(ref, "/"); i > 0 && strings.ContainsAny(ref[:i], ".:") {
+		name = strings.ToLower(ref[:i]) + ref[i:]
+	}
+	if !imageRefPattern.MatchString(name) {
+		return "is not a valid image reference"
+	}
+	return ""
+}
+
+// ValidateServiceArgs checks the arguments of a manual StartService.
+func ValidateServiceArgs(id, image, port string) error {
+	var ve ValidationError
+
+	if !containerNamePattern.MatchString(id) {
+		ve.add("serviceID", "must be letters, digits, '.', '_' or '-', starting with a letter or digit")
+	}
+	if err := validateImageRef(image); err != "" {
+		ve.add("image", "%s", err)
+	}
+	if _, err := parsePortMapping(port); err != nil {
+		ve.add("port", "%s", err)
+	}
+
+	return ve.err()
+}
@@ -0,0 +1,118 @@
+// ==========================
+// profile_schema_test.go
+// ==========================
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// decodeJSON runs a profile document through DecodeProfile as the API does.
+func decodeJSON(t *testing.T, doc string) (ServiceProfile, error) {
+	t.Helper()
+	var raw map[string]any
+	if err := json.Unmarshal([]byte(doc), &raw); err != nil {
+		t.Fatalf("bad test document %s: %v", doc, err)
+	}
+	return DecodeProfile(raw)
+}
+
+// errorFields lists the field paths of a ValidationError, or nil.
+func errorFields(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("not a ValidationError: %v", err)
+	}
+	fields := []string{}
+	for _, fe := range ve.Errors {
+		fields = append(fields, fe.Field)
+	}
+	return fields
+}
+
+// sha256Hex is a well-formed digest for image references.
+const sha256Hex = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestDecodeProfileFieldErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{"valid v2", `{"schemaVersion":2,"name":"Web","image":"nginx:1.27","containerPort":80}`, nil},
+		{"valid v1", `{"name":"Web","image":"nginx","containerPort":80}`, nil},
+
+		// schemaVersion bounds
+		{"version 0", `{"schemaVersion":0,"name":"Web","image":"nginx","containerPort":80}`, []string{"schemaVersion"}},
+		{"negative version", `{"schemaVersion":-1,"name":"Web","image":"nginx","containerPort":80}`, []string{"schemaVersion"}},
+		{"fractional version", `{"schemaVersion":1.5,"name":"Web","image":"nginx","containerPort":80}`, []string{"schemaVersion"}},
+		{"string version", `{"schemaVersion":"2","name":"Web","image":"nginx","containerPort":80}`, []string{"schemaVersion"}},
+		{"future version", `{"schemaVersion":3,"name":"Web","image":"nginx","containerPort":80}`, []string{"schemaVersion"}},
+
+		// unknown fields, at any depth
+		{"unknown top-level", `{"name":"Web","image":"nginx","containerPort":80,"port":80}`, []string{"port"}},
+		{"unknown nested", `{"name":"Web","image":"nginx","containerPort":80,"healthCheck":{"tcp":true,"x":1}}`, []string{"healthCheck.x"}},
+		{"unknown in list", `{"name":"Web","image":"nginx","containerPort":80,"volumes":[{"name":"d","target":"/d","y":1}]}`, []string{"volumes[0].y"}},
+
+		// wrong types
+		{"string port", `{"name":"Web","image":"nginx","containerPort":"80"}`, []string{"containerPort"}},
+		{"nested type", `{"name":"Web","image":"nginx","containerPort":80,"healthCheck":{"tcp":"yes"}}`, []string{"healthCheck.tcp"}},
+		{"v2 env number", `{"schemaVersion":2,"name":"Web","image":"nginx","containerPort":80,"env":{"PORT":5000}}`, []string{"env.PORT"}},
+
+		// values
+		{"bad name", `{"name":"-web","image":"nginx","containerPort":80}`, []string{"name"}},
+		{"port out of range", `{"name":"Web","image":"nginx","containerPort":70000}`, []string{"containerPort"}},
+		{"missing image", `{"name":"Web","containerPort":80}`, []string{"image"}},
+		{"image whitespace", `{"name":"Web","image":"nginx latest","containerPort":80}`, []string{"image"}},
+		{"image upper case", `{"name":"Web","image":"Nginx","containerPort":80}`, []string{"image"}},
+		{"registry upper case", `{"name":"Web","image":"Registry.example.com:5000/team/app:v1","containerPort":80}`, nil},
+		{"image digest", `{"name":"Web","image":"nginx@sha256:` + sha256Hex + `","containerPort":80}`, nil},
+		{"bad restart mode", `{"name":"Web","image":"nginx","containerPort":80,"restartPolicy":{"mode":"sometimes"}}`, []string{"restartPolicy.mode"}},
+		{"two health checks", `{"name":"Web","image":"nginx","containerPort":80,"healthCheck":{"tcp":true,"httpPath":"/"}}`, []string{"healthCheck"}},
+		{"bad strategy", `{"name":"Web","image":"nginx","containerPort":80,"loadBalancing":{"strategy":"random"}}`, []string{"loadBalancing.strategy"}},
+		{"bad group", `{"name":"Web","image":"nginx","containerPort":80,"groups":["ok","-no"]}`, []string{"groups[1]"}},
+		{"relative target", `{"name":"Web","image":"nginx","containerPort":80,"volumes":[{"name":"d","target":"data"}]}`, []string{"volumes[0].target"}},
+		{"duplicate target", `{"name":"Web","image":"nginx","containerPort":80,"volumes":[{"name":"a","target":"/data"},{"hostPath":"/srv","target":"/data/"}]}`, []string{"volumes[1].target"}},
+		{"name and hostPath", `{"name":"Web","image":"nginx","containerPort":80,"volumes":[{"name":"a","hostPath":"/srv","target":"/a"}]}`, []string{"volumes[0]"}},
+	}
+
+	for _, c := range cases {
+		_, err := decodeJSON(t, c.doc)
+		if got := errorFields(t, err); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: error fields %v, want %v (%v)", c.name, got, c.want, err)
+		}
+	}
+}
+
+// Version 1 documents had env values of any scalar type.
+func TestMigrateProfileV1Env(t *testing.T) {
+	p, err := decodeJSON(t, `{"name":"Web","image":"nginx","containerPort":80,"env":{"PORT":5000,"RATIO":0.5,"DEBUG":true,"EMPTY":null,"NAME":"x"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"PORT": "5000", "RATIO": "0.5", "DEBUG": "true", "EMPTY": "", "NAME": "x"}
+	if !reflect.DeepEqual(p.Env, want) {
+		t.Errorf("env %v, want %v", p.Env, want)
+	}
+	if p.SchemaVersion != ProfileSchemaVersion {
+		t.Errorf("schemaVersion %d after migration", p.SchemaVersion)
+	}
+}
+
+func TestValidateProfileGoValue(t *testing.T) {
+	// Profiles built in Go have no schemaVersion and are current.
+	if err := ValidateProfile(ServiceProfile{Name: "Web", Image: "nginx", ContainerPort: 80}); err != nil {
+		t.Error(err)
+	}
+	err := ValidateProfile(ServiceProfile{Name: "Web", Image: "nginx", ContainerPort: 80, RateLimitPerMin: -1, Env: map[string]string{"A=B": "c"}})
+	if got := errorFields(t, err); !reflect.DeepEqual(got, []string{"env.A=B", "rateLimitPerMin"}) {
+		t.Errorf("error fields %v", got)
+	}
+}
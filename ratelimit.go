@@ -0,0 +1,57 @@
+// ==========================
+// ratelimit.go
+// ==========================
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter counts requests per key in fixed one-minute windows.
+type RateLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{windows: map[string]*rateWindow{}}
+}
+
+// Allow records a request for key and reports whether it is within
+// perMin for the current minute. perMin <= 0 means unlimited.
+func (rl *RateLimiter) Allow(key string, perMin int) bool {
+	if perMin <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	w, ok := rl.windows[key]
+	if !ok || now.Sub(w.start) >= time.Minute {
+		rl.prune(now)
+		w = &rateWindow{start: now}
+		rl.windows[key] = w
+	}
+	if w.count >= perMin {
+		return false
+	}
+	w.count++
+	return true
+}
+
+// prune drops finished windows. Callers hold rl.mu.
+func (rl *RateLimiter) prune(now time.Time) {
+	for k, w := range rl.windows {
+		if now.Sub(w.start) >= time.Minute {
+			delete(rl.windows, k)
+		}
+	}
+}
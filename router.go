@@ -8,78 +8,83 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
-	libp2p "github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
-	circuit "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
 )
 
 const (
 	RouterProtocolID = "/undocked/router/1.0.0"
+
+	// routeServiceHeader names the service a routed request is for, so the
+	// receiving peer knows which local container to hand it to.
+	routeServiceHeader = "X-Undocked-Service"
+
+	// translateProfile serves /v1/translate.
+	translateProfile = "LibreTranslate"
 )
 
 type Router struct {
 	mu       sync.RWMutex
 	ctx      context.Context
 	host     host.Host
+	node     *ServiceNode
 	sessions *SessionManager
 	stats    *StatsManager
 	peers    *PeerRegistry
-	httpSrv  *http.Server
 	banlist  *BanList
+	limits   *RateLimiter
 }
 
-func NewRouter(ctx context.Context, peers *PeerRegistry, stats *StatsManager) (*Router, error) {
-	h, err := libp2p.New(
-		libp2p.EnableRelay(),
-		libp2p.EnableNATService(),
-		libp2p.NATPortMap(),
-		libp2p.Transport(circuit.New),
-	)
-	if err != nil {
-		return nil, err
-	}
-
+// NewRouter serves routed requests over the node's libp2p host. Without a
+// host (P2P failed to start) it can still route to local services.
+func NewRouter(ctx context.Context, node *ServiceNode) (*Router, error) {
 	r := &Router{
 		ctx:      ctx,
-		host:     h,
+		host:     node.host,
+		node:     node,
 		sessions: NewSessionManager(),
-		stats:    stats,
-		peers:    peers,
+		stats:    node.stats,
+		peers:    node.registry,
 		banlist:  NewBanList(),
+		limits:   NewRateLimiter(),
 	}
 
-	h.SetStreamHandler(RouterProtocolID, r.handleStream)
+	if r.host != nil {
+		r.host.SetStreamHandler(RouterProtocolID, r.handleStream)
+	}
 	return r, nil
 }
 
-func (r *Router) StartHTTP(addr string) error {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/v1/translate", r.handleHTTP)
-	mux.HandleFunc("/v1/stats", r.handleStats)
-	mux.HandleFunc("/v1/ban", r.handleBan)
-
-	r.httpSrv = &http.Server{
-		Addr:    addr,
-		Handler: mux,
+// Close stops serving routed streams. The host belongs to the node.
+func (r *Router) Close() error {
+	if r.host != nil {
+		r.host.RemoveStreamHandler(RouterProtocolID)
 	}
-
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
-	}
-
-	go r.httpSrv.Serve(ln)
 	return nil
 }
 
 func (r *Router) handleHTTP(w http.ResponseWriter, req *http.Request) {
+	r.route(w, req, translateProfile, "/translate")
+}
+
+// handleProxy routes /v1/proxy/{profile}/{path...} to any healthy peer
+// running profile.
+func (r *Router) handleProxy(w http.ResponseWriter, req *http.Request) {
+	r.route(w, req, req.PathValue("profile"), "/"+req.PathValue("path"))
+}
+
+func (r *Router) route(w http.ResponseWriter, req *http.Request, profile, path string) {
 	if r.banlist.IsBanned(req.RemoteAddr) {
 		http.Error(w, "banned", http.StatusForbidden)
 		return
@@ -88,24 +93,51 @@ func (r *Router) handleHTTP(w http.ResponseWriter, req *http.Request) {
 	session := r.sessions.NewSession(req.RemoteAddr)
 	defer r.sessions.End(session.ID)
 
-	target, err := r.peers.SelectLeastLoaded()
+	lb := r.peers.LoadBalancing(profile)
+	target, err := r.peers.Select(profile, lb.requestKey(req))
 	if err != nil {
 		http.Error(w, err.Error(), 503)
 		return
 	}
 
-	resp, err := r.forwardHTTP(req.Context(), target.PeerID, req)
+	out := req.Clone(req.Context())
+	out.URL.Path = path
+	out.URL.RawPath = ""
+	out.RequestURI = ""
+	out.Header.Set(routeServiceHeader, target.ServiceID)
+
+	var resp *http.Response
+	start := time.Now()
+	if r.host == nil || target.PeerID == r.host.ID() {
+		resp, err = r.serveLocal(out, "")
+	} else {
+		resp, err = r.forwardHTTP(req.Context(), target.PeerID, out)
+	}
+	if err == nil && resp.StatusCode >= 500 {
+		r.peers.Observe(target, time.Since(start), errors.New(resp.Status))
+	} else {
+		r.peers.Observe(target, time.Since(start), err)
+	}
 	if err != nil {
 		r.stats.RecordError(target.ServiceID)
 		http.Error(w, err.Error(), 502)
 		return
 	}
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	n, _ := io.Copy(w, resp.Body)
 
-	r.stats.RecordRequest(target.ServiceID, int64(len(resp)))
-	w.Write(resp)
+	if resp.StatusCode >= 500 {
+		r.stats.RecordError(target.ServiceID)
+	}
+	r.stats.RecordRequest(target.ServiceID, n)
 }
 
-func (r *Router) forwardHTTP(ctx context.Context, peerID peer.ID, req *http.Request) ([]byte, error) {
+func (r *Router) forwardHTTP(ctx context.Context, peerID peer.ID, req *http.Request) (*http.Response, error) {
 	s, err := r.host.NewStream(ctx, peerID, RouterProtocolID)
 	if err != nil {
 		return nil, err
@@ -115,27 +147,34 @@ func (r *Router) forwardHTTP(ctx context.Context, peerID peer.ID, req *http.Requ
 	if err := req.Write(s); err != nil {
 		return nil, err
 	}
+	if err := s.CloseWrite(); err != nil {
+		return nil, err
+	}
 
-	return io.ReadAll(s)
+	resp, err := http.ReadResponse(bufio.NewReader(s), req)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	return resp, nil
 }
 
 func (r *Router) handleStream(s network.Stream) {
 	defer s.Close()
 
-	data, err := io.ReadAll(s)
-	if err != nil {
-		return
-	}
-
-	reader := bufio.NewReader(bytes.NewReader(data))
-	req, err := http.ReadRequest(reader)
+	req, err := http.ReadRequest(bufio.NewReader(s))
 	if err != nil {
 		return
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := r.serveLocal(req, s.Conn().RemotePeer())
 	if err != nil {
-		return
+		resp = textResponse(http.StatusBadGateway, err.Error())
 	}
 	defer resp.Body.Close()
 
@@ -145,6 +184,58 @@ func (r *Router) handleStream(s network.Stream) {
 	}
 }
 
+// serveLocal sends a routed request to the local service named in its
+// routeServiceHeader. Only running services started from a profile with
+// exposeHTTP are reachable this way. from is the requesting peer, or
+// empty for our own API.
+func (r *Router) serveLocal(req *http.Request, from peer.ID) (*http.Response, error) {
+	id := req.Header.Get(routeServiceHeader)
+	svc, ok := r.node.runningService(id)
+	if !ok || svc.Profile == "" || svc.HostPort == "" {
+		return nil, fmt.Errorf("service %q is not running here", id)
+	}
+
+	profile, ok := r.node.config.Get(svc.Profile)
+	if !ok || !profile.ExposeHTTP {
+		return textResponse(http.StatusForbidden, "service is not exposed"), nil
+	}
+	if from != "" {
+		if profile.AuthRequired && !r.node.sharesGroup(from.String(), nil) {
+			return textResponse(http.StatusForbidden, "service is only available to group members"), nil
+		}
+		// Group-only profiles are served to members of those groups, not
+		// just hidden from everyone else's announcements.
+		if len(profile.Groups) > 0 && !slices.Contains(profile.Groups, publicGroup) &&
+			!r.node.sharesGroup(from.String(), profile.Groups) {
+			return textResponse(http.StatusForbidden, "service is only available to its groups"), nil
+		}
+		if !r.limits.Allow(from.String()+"/"+profile.Name, profile.RateLimitPerMin) {
+			return textResponse(http.StatusTooManyRequests, "rate limit exceeded"), nil
+		}
+	}
+
+	done := r.stats.Begin(id)
+	defer done()
+
+	req.Header.Del(routeServiceHeader)
+	req.RequestURI = ""
+	req.URL.Scheme = "http"
+	req.URL.Host = net.JoinHostPort("127.0.0.1", svc.HostPort)
+	req.Host = req.URL.Host
+	return http.DefaultClient.Do(req)
+}
+
+func textResponse(code int, msg string) *http.Response {
+	return &http.Response{
+		StatusCode: code,
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:       io.NopCloser(strings.NewReader(msg)),
+	}
+}
+
 func (r *Router) handleStats(w http.ResponseWriter, _ *http.Request) {
 	json.NewEncoder(w).Encode(r.stats.Snapshot())
 }
@@ -152,6 +243,25 @@ func (r *Router) handleStats(w http.ResponseWriter, _ *http.Request) {
 func (r *Router) handleBan(w http.ResponseWriter, req *http.Request) {
 	var p struct{ Addr string }
 	json.NewDecoder(req.Body).Decode(&p)
+	if p.Addr == "" {
+		http.Error(w, "addr is required", 400)
+		return
+	}
 	r.banlist.Ban(p.Addr)
 	w.WriteHeader(http.StatusOK)
 }
+
+func (r *Router) handleUnban(w http.ResponseWriter, req *http.Request) {
+	var p struct{ Addr string }
+	json.NewDecoder(req.Body).Decode(&p)
+	if p.Addr == "" {
+		http.Error(w, "addr is required", 400)
+		return
+	}
+	r.banlist.Unban(p.Addr)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *Router) handleBans(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(r.banlist.List())
+}
@@ -3,39 +3,137 @@
 // ==========================
 package main
 
-import "fmt"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrProfileNotFound  = errors.New("service profile not found")
+	ErrInstanceNotFound = errors.New("service instance not found")
+)
+
+// newInstanceID returns a fresh container name for a profile instance.
+func newInstanceID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return "svc-" + hex.EncodeToString(b)
+}
 
 func (sn *ServiceNode) StartFromProfile(name string, hostPort int) string {
+	if _, err := sn.StartInstance(name, hostPort, nil); err != nil {
+		return err.Error()
+	}
+	return "service started"
+}
+
+// StartInstance runs a new instance of a profile on hostPort. env is
+// merged over the profile's own environment for this instance only.
+func (sn *ServiceNode) StartInstance(name string, hostPort int, env map[string]string) (ServiceInstance, error) {
 	profile, ok := sn.config.Get(name)
 	if !ok {
-		return "service profile not found"
+		return ServiceInstance{}, ErrProfileNotFound
 	}
 
-	port := fmt.Sprintf("%d", hostPort)
-	containerPort := fmt.Sprintf("%d", profile.ContainerPort)
-
-	args := []string{
-		"run", "-d",
-		"--name", name,
-		"-p", port + ":" + containerPort,
+	if hostPort < 1 || hostPort > 65535 {
+		return ServiceInstance{}, fmt.Errorf("invalid port %d", hostPort)
 	}
 
+	merged := make(map[string]string, len(profile.Env)+len(env))
 	for k, v := range profile.Env {
-		args = append(args, "-e", k+"="+v)
+		merged[k] = v
+	}
+	for k, v := range env {
+		if k == "" || strings.Contains(k, "=") {
+			return ServiceInstance{}, fmt.Errorf("invalid env variable name %q", k)
+		}
+		merged[k] = v
 	}
 
-	args = append(args, profile.Image)
-	args = append(args, profile.Command...)
+	id := newInstanceID()
 
-	if _, err := execDockerOutput(args...); err != nil {
-		return err.Error()
+	if err := sn.ensureImage(id, profile.Image); err != nil {
+		return ServiceInstance{}, err
 	}
 
-	if err := WaitForRunning(name, 15); err != nil {
-		return err.Error()
+	mounts, err := sn.profileMounts(profile)
+	if err != nil {
+		return ServiceInstance{}, err
+	}
+
+	spec := ContainerSpec{
+		Name:  id,
+		Image: profile.Image,
+		Env:   merged,
+		Cmd:   profile.Command,
+		Labels: map[string]string{
+			ProfileLabel: profile.Name,
+		},
+		Ports: []PortBinding{{
+			HostPort:      strconv.Itoa(hostPort),
+			ContainerPort: strconv.Itoa(profile.ContainerPort),
+		}},
+		Mounts: mounts,
+	}
+
+	if err := sn.runContainer(spec); err != nil {
+		sn.stopAndRemove(id)
+		return ServiceInstance{}, err
+	}
+
+	if err := sn.waitForRunning(id, 15*time.Second); err != nil {
+		sn.markStopping(id)
+		sn.stopAndRemove(id)
+		return ServiceInstance{}, err
 	}
 
 	sn.refreshServices()
 	sn.BroadcastServices()
-	return "service started"
+
+	return ServiceInstance{
+		InstanceID: id,
+		ProfileID:  profile.Name,
+		Port:       hostPort,
+		Addr:       net.JoinHostPort("127.0.0.1", strconv.Itoa(hostPort)),
+		StartedAt:  time.Now(),
+	}, nil
+}
+
+// StopInstance stops and removes an instance started from a profile,
+// including one the supervisor is waiting to restart.
+func (sn *ServiceNode) StopInstance(instanceID string) error {
+	for _, s := range sn.ListServices() {
+		if s.ServiceID == instanceID && s.Profile != "" {
+			sn.StopService(instanceID)
+			return nil
+		}
+	}
+	return ErrInstanceNotFound
+}
+
+// ListInstances returns the running services that were started from a
+// profile.
+func (sn *ServiceNode) ListInstances() []ServiceInstance {
+	out := []ServiceInstance{}
+	for _, s := range sn.ListServices() {
+		if s.Profile == "" || s.Status != "running" {
+			continue
+		}
+		port, _ := strconv.Atoi(s.HostPort)
+		started, _ := time.Parse(time.RFC3339, s.StartedAt)
+		out = append(out, ServiceInstance{
+			InstanceID: s.ServiceID,
+			ProfileID:  s.Profile,
+			Port:       port,
+			Addr:       net.JoinHostPort("127.0.0.1", s.HostPort),
+			StartedAt:  started,
+		})
+	}
+	return out
 }
@@ -0,0 +1,108 @@
+// ==========================
+// service_logs.go
+// ==========================
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// StartLogFollowers begins following output for every running service.
+// Services started later are picked up from container events.
+func (sn *ServiceNode) StartLogFollowers() {
+	for _, s := range sn.ListServices() {
+		if s.Status == "running" {
+			sn.followLogs(s.ServiceID)
+		}
+	}
+}
+
+// followLogs tails a service's container into the log store until the
+// container stops. Calling it for a service already being followed is a
+// no-op.
+func (sn *ServiceNode) followLogs(serviceID string) {
+	sn.mu.Lock()
+	if _, ok := sn.followers[serviceID]; ok {
+		sn.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(sn.ctx)
+	sn.followers[serviceID] = cancel
+	sn.mu.Unlock()
+
+	go func() {
+		defer func() {
+			sn.mu.Lock()
+			delete(sn.followers, serviceID)
+			sn.mu.Unlock()
+			cancel()
+		}()
+
+		since := sn.logs.Last(serviceID)
+		_ = sn.backend.FollowLogs(ctx, serviceID, since, func(l LogLine) {
+			l.ServiceID = serviceID
+			sn.recordLog(l)
+		})
+	}()
+}
+
+// releaseLogs stops following a removed instance and closes its log file;
+// the bounded history is kept for later export.
+func (sn *ServiceNode) releaseLogs(serviceID string) {
+	sn.mu.Lock()
+	if cancel, ok := sn.followers[serviceID]; ok {
+		cancel()
+		delete(sn.followers, serviceID)
+	}
+	sn.mu.Unlock()
+
+	sn.logs.Release(serviceID)
+}
+
+// recordLog stores a line and pushes it to the UI.
+func (sn *ServiceNode) recordLog(l LogLine) {
+	_ = sn.logs.Append(l)
+	sn.emit("service-log-line", l)
+}
+
+// systemLog records one of undocked's own messages about a service, such
+// as image pull progress.
+func (sn *ServiceNode) systemLog(serviceID, msg string) {
+	sn.emit("service-log", msg)
+	sn.recordLog(LogLine{
+		ServiceID: serviceID,
+		Stream:    "system",
+		Time:      time.Now(),
+		Message:   msg,
+	})
+}
+
+// --------------------------
+// Queries
+// --------------------------
+
+func (sn *ServiceNode) TailLogs(serviceID string, n int) ([]LogLine, error) {
+	return sn.logs.Tail(serviceID, n)
+}
+
+func (sn *ServiceNode) LogsSince(serviceID string, since time.Time, n int) ([]LogLine, error) {
+	return sn.logs.Since(serviceID, since, n)
+}
+
+func (sn *ServiceNode) SearchLogs(serviceID, query string, limit int) ([]LogLine, error) {
+	return sn.logs.Search(serviceID, query, limit)
+}
+
+func (sn *ServiceNode) ExportLogs(serviceID, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := sn.logs.Export(serviceID, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -5,6 +5,8 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -18,51 +20,132 @@ type ServiceNode struct {
 	mu     sync.Mutex
 	ctx    context.Context
 	cancel context.CancelFunc
+	ui     context.Context // Wails context; nil when headless
 
 	// App subsystems
-	stats  *StatsManager
-	config *ServiceConfigStore
+	stats    *StatsManager
+	registry *PeerRegistry
+	config   *ServiceConfigStore
+	backend  ContainerBackend
+	metrics  *MetricsSampler
+	logs     *LogStore
+	health   *HealthMonitor
+
+	// Config
+	cfg         NodeConfig
+	profilesDir string
 
 	// Runtime state
-	peers    map[string]*PeerInfo
-	services map[string]Service
+	peers     map[string]*PeerInfo
+	peerViews map[string]map[string]*peerView // peer -> channel -> announcement
+	groups    map[string]Group
+
+	// legacySeen is when a peer last sent a pre-envelope JSON
+	// announcement; while that's recent we send JSON as well.
+	legacySeen time.Time
+	services   map[string]Service
+	followers  map[string]context.CancelFunc
+	restarts   map[string]*restartState
+	stopping   map[string]struct{}
 
 	// P2P
-	host  host.Host
-	ps    *pubsub.PubSub
-	topic *pubsub.Topic
+	host     host.Host
+	ps       *pubsub.PubSub
+	channels map[string]*gossipChannel
+	dht      *DHT
 }
 
-func NewServiceNode() *ServiceNode {
+func NewServiceNode(cfg NodeConfig, backend ContainerBackend) *ServiceNode {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	config := NewServiceConfigStore()
-	LoadRecommendedServices(config)
+	if err := LoadRecommendedServices(config); err != nil {
+		fmt.Println("Error loading recommended services:", err)
+	}
+	if err := config.Persist(filepath.Join(cfg.Dir, "profiles.json")); err != nil {
+		fmt.Println("Error loading saved profiles:", err)
+	}
 
 	sn := &ServiceNode{
-		ctx:      ctx,
-		cancel:   cancel,
-		config:   config,
-		stats:    NewStatsManager(),
-		peers:    make(map[string]*PeerInfo),
-		services: make(map[string]Service),
+		ctx:         ctx,
+		cancel:      cancel,
+		cfg:         cfg,
+		profilesDir: filepath.Join(cfg.Dir, "profiles.d"),
+		config:      config,
+		backend:     backend,
+		metrics:     NewMetricsSampler(backend, metricsInterval, metricsCapacity),
+		logs:        NewLogStore(filepath.Join(cfg.Dir, "logs"), defaultLogMaxBytes),
+		stats:       NewStatsManager(),
+		registry:    NewPeerRegistry(config),
+		peers:       make(map[string]*PeerInfo),
+		peerViews:   make(map[string]map[string]*peerView),
+		groups:      make(map[string]Group),
+		channels:    make(map[string]*gossipChannel),
+		services:    make(map[string]Service),
+		followers:   make(map[string]context.CancelFunc),
+		restarts:    make(map[string]*restartState),
+		stopping:    make(map[string]struct{}),
+	}
+
+	sn.reloadProfileDir()
+	if err := sn.loadGroups(); err != nil {
+		fmt.Println("Error loading groups:", err)
 	}
+	config.OnChange(sn.onProfilesChanged)
 
+	sn.health = NewHealthMonitor(backend, sn.onHealthChange)
 	sn.refreshServices()
 
 	return sn
 }
 
+// SetWailsContext attaches the desktop UI. Until it is called, events are
+// dropped, which is how the headless daemon runs.
 func (sn *ServiceNode) SetWailsContext(ctx context.Context) {
-	sn.ctx = ctx
+	sn.ui = ctx
+}
+
+func (sn *ServiceNode) emit(name string, data ...interface{}) {
+	if sn.ui == nil {
+		return
+	}
+	runtime.EventsEmit(sn.ui, name, data...)
+}
+
+// Close stops every background loop and releases the P2P host. Running
+// containers are left alone.
+func (sn *ServiceNode) Close() {
+	sn.sayGoodbye()
+	sn.cancel()
+	if sn.host != nil {
+		sn.host.Close()
+	}
+	sn.logs.Close()
+}
+
+func (sn *ServiceNode) Snapshot() NodeSnapshot {
+	return NodeSnapshot{
+		Services: sn.ListServices(),
+		Peers:    sn.GetPeers(),
+		Stats:    sn.stats.Snapshot(),
+		Metrics:  sn.metrics.Summary(),
+	}
 }
 
 // --------------------------
-// Docker
+// Container backend
 // --------------------------
 
+// CheckDockerStatus emits whether the configured backend is reachable. The
+// event keeps its name for the UI even when the backend is Podman.
 func (sn *ServiceNode) CheckDockerStatus() {
-	runtime.EventsEmit(sn.ctx, "docker-status", DockerRunning())
+	sn.emit("docker-status", sn.backendRunning())
+}
+
+// StartMetricsSampler begins collecting resource usage for every running
+// service.
+func (sn *ServiceNode) StartMetricsSampler() {
+	go sn.metrics.Run(sn.ctx)
 }
 
 // --------------------------
@@ -70,32 +153,39 @@ func (sn *ServiceNode) CheckDockerStatus() {
 // --------------------------
 
 func (sn *ServiceNode) StartService(id, image, port string) string {
-	if !DockerRunning() {
-		return "Docker is not running"
+	if err := ValidateServiceArgs(id, image, port); err != nil {
+		return err.Error()
+	}
+
+	if !sn.backendRunning() {
+		return sn.backend.Name() + " is not running"
 	}
 
-	exists, running := ContainerState(id)
+	exists, running := sn.containerState(id)
 	if exists && running {
 		return "Service already running"
 	}
 
-	if !DockerImageExists(image) {
-		_ = PullDockerImage(sn.ctx, image, func(s string) {
-			runtime.EventsEmit(sn.ctx, "service-log", s)
-		})
+	if err := sn.ensureImage(id, image); err != nil {
+		return err.Error()
 	}
 
 	if exists && !running {
-		if err := execDocker("start", id); err != nil {
+		if err := sn.startContainer(id); err != nil {
 			return err.Error()
 		}
 	} else {
-		if err := RunContainer(id, image, port); err != nil {
+		binding, err := parsePortMapping(port)
+		if err != nil {
+			return err.Error()
+		}
+		spec := ContainerSpec{Name: id, Image: image, Ports: []PortBinding{binding}}
+		if err := sn.runContainer(spec); err != nil {
 			return err.Error()
 		}
 	}
 
-	if err := WaitForRunning(id, 15*time.Second); err != nil {
+	if err := sn.waitForRunning(id, 15*time.Second); err != nil {
 		return err.Error()
 	}
 
@@ -105,12 +195,20 @@ func (sn *ServiceNode) StartService(id, image, port string) string {
 }
 
 func (sn *ServiceNode) StopService(id string) string {
-	StopAndRemove(id)
+	// Tell peers first; stopping the container can take a while.
+	sn.markStopping(id)
+	sn.WithdrawServices(id)
+	sn.stopAndRemove(id)
 	sn.refreshServices()
 	sn.BroadcastServices()
 	return "service stopped"
 }
 
+// ServiceMetrics returns a service's resource samples for the last window.
+func (sn *ServiceNode) ServiceMetrics(id string, window time.Duration) []MetricSample {
+	return sn.metrics.Samples(id, window)
+}
+
 func (sn *ServiceNode) ListServices() []Service {
 	sn.mu.Lock()
 	defer sn.mu.Unlock()
@@ -122,6 +220,13 @@ func (sn *ServiceNode) ListServices() []Service {
 	return out
 }
 
+func (sn *ServiceNode) runningService(id string) (Service, bool) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	s, ok := sn.services[id]
+	return s, ok && s.Status == "running"
+}
+
 // --------------------------
 // Peers
 // --------------------------
@@ -142,13 +247,15 @@ func (sn *ServiceNode) GetPeers() []PeerInfo {
 // --------------------------
 
 func (sn *ServiceNode) refreshServices() {
-	svcs, err := ListRunningServices()
+	svcs, err := sn.listRunningServices()
 	if err != nil {
 		return
 	}
 
 	stats := sn.stats.Snapshot()
 
+	sn.syncHealthChecks(svcs)
+
 	sn.mu.Lock()
 	defer sn.mu.Unlock()
 
@@ -159,6 +266,56 @@ func (sn *ServiceNode) refreshServices() {
 			s.Errors = st.Errors
 			s.Bandwidth = st.Bandwidth
 		}
+		s.Health = sn.health.Status(s.ServiceID)
+		if p, ok := sn.config.Get(s.Profile); ok && p.LoadBalancing != nil {
+			s.Weight = p.LoadBalancing.weight()
+		}
 		sn.services[s.ServiceID] = s
 	}
+	sn.applyRestartState(sn.services)
+}
+
+// syncHealthChecks probes every running service whose profile declares a
+// health check and stops probing services that are gone.
+func (sn *ServiceNode) syncHealthChecks(running []Service) {
+	live := map[string]struct{}{}
+	for _, s := range running {
+		live[s.ServiceID] = struct{}{}
+
+		profile, ok := sn.config.Get(s.Profile)
+		if !ok || profile.HealthCheck == nil {
+			continue
+		}
+		sn.health.Watch(sn.ctx, s, *profile.HealthCheck)
+	}
+
+	for _, id := range sn.health.Watched() {
+		if _, ok := live[id]; !ok {
+			sn.health.Unwatch(id)
+		}
+	}
+}
+
+func (sn *ServiceNode) onProfilesChanged() {
+	sn.emit("profiles-updated", sn.config.List())
+}
+
+func (sn *ServiceNode) onHealthChange(serviceID, status string) {
+	sn.mu.Lock()
+	s, ok := sn.services[serviceID]
+	if ok {
+		s.Health = status
+		sn.services[serviceID] = s
+	}
+	sn.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	sn.emit("service-health", map[string]string{
+		"serviceID": serviceID,
+		"health":    status,
+	})
+	sn.BroadcastServices()
 }
@@ -0,0 +1,265 @@
+// ==========================
+// service_node_test.go
+// ==========================
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestNode(t *testing.T, profiles ...ServiceProfile) (*ServiceNode, *FakeBackend) {
+	t.Helper()
+	fake := NewFakeBackend()
+	sn := NewServiceNode(NodeConfig{Dir: t.TempDir()}, fake)
+	t.Cleanup(sn.Close)
+
+	for _, p := range profiles {
+		if err := sn.config.Add(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sn.WatchContainerEvents()
+	waitFor(t, "event watcher", func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.watchers) > 0
+	})
+	return sn, fake
+}
+
+func echoProfile() ServiceProfile {
+	return ServiceProfile{
+		Name:          "Echo",
+		Image:         "example/echo:1",
+		ContainerPort: 5678,
+		ExposeHTTP:    true,
+	}
+}
+
+// waitFor polls cond until it holds or a few seconds pass.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func serviceState(sn *ServiceNode, id string) Service {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	return sn.services[id]
+}
+
+func TestServiceNodeInstanceLifecycle(t *testing.T) {
+	sn, fake := newTestNode(t, echoProfile())
+
+	inst, err := sn.StartInstance("Echo", 18080, map[string]string{"GREETING": "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sn.ListInstances(); len(got) != 1 || got[0].InstanceID != inst.InstanceID {
+		t.Fatalf("instances: %+v", got)
+	}
+	if s := serviceState(sn, inst.InstanceID); s.Status != "running" || s.HostPort != "18080" {
+		t.Fatalf("service: %+v", s)
+	}
+
+	// Container output reaches the log store through the follower.
+	waitFor(t, "log follower", func() bool {
+		sn.mu.Lock()
+		defer sn.mu.Unlock()
+		_, ok := sn.followers[inst.InstanceID]
+		return ok
+	})
+	if err := fake.WriteLog(inst.InstanceID, "stdout", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "log line", func() bool {
+		lines, _ := sn.TailLogs(inst.InstanceID, 10)
+		for _, l := range lines {
+			if l.Message == "hello" && l.Stream == "stdout" {
+				return true
+			}
+		}
+		return false
+	})
+
+	if err := sn.StopInstance(inst.InstanceID); err != nil {
+		t.Fatal(err)
+	}
+	if got := sn.ListInstances(); len(got) != 0 {
+		t.Errorf("instances after stop: %+v", got)
+	}
+	if lines, _ := sn.TailLogs(inst.InstanceID, 10); len(lines) == 0 {
+		t.Error("history of a removed instance was deleted")
+	}
+	sn.mu.Lock()
+	_, following := sn.followers[inst.InstanceID]
+	sn.mu.Unlock()
+	if following {
+		t.Error("removed instance still followed")
+	}
+	sn.mu.Lock()
+	stopping := len(sn.stopping)
+	sn.mu.Unlock()
+	if stopping != 0 {
+		t.Errorf("%d services still marked stopping", stopping)
+	}
+}
+
+// Stopping a container that already exited must not leave it marked as
+// stopping, or it would never be announced or supervised again.
+func TestServiceNodeStopExitedInstance(t *testing.T) {
+	sn, fake := newTestNode(t, echoProfile())
+
+	inst, err := sn.StartInstance("Echo", 18080, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Exit(inst.InstanceID, 1); err != nil {
+		t.Fatal(err)
+	}
+	sn.StopService(inst.InstanceID)
+
+	sn.mu.Lock()
+	_, marked := sn.stopping[inst.InstanceID]
+	sn.mu.Unlock()
+	if marked {
+		t.Error("exited instance left marked as stopping")
+	}
+}
+
+func TestServiceNodeRestartsCrashedInstance(t *testing.T) {
+	p := echoProfile()
+	p.RestartPolicy = &RestartPolicy{Mode: RestartOnFailure, MaxRetries: 3}
+	sn, fake := newTestNode(t, p)
+
+	inst, err := sn.StartInstance("Echo", 18080, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fake.Exit(inst.InstanceID, 1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "restart", func() bool {
+		s := serviceState(sn, inst.InstanceID)
+		return s.Status == "running" && s.Restarts == 1
+	})
+
+	// A clean exit isn't a failure.
+	if err := fake.Exit(inst.InstanceID, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(minRestartBackoff + 500*time.Millisecond)
+	if s := serviceState(sn, inst.InstanceID); s.Status == "running" {
+		t.Errorf("restarted after exit code 0: %+v", s)
+	}
+}
+
+// A failed restart is retried with backoff rather than given up on.
+func TestServiceNodeRetriesFailedRestart(t *testing.T) {
+	p := echoProfile()
+	p.RestartPolicy = &RestartPolicy{Mode: RestartAlways}
+	sn, fake := newTestNode(t, p)
+
+	inst, err := sn.StartInstance("Echo", 18080, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.FailStarts(1)
+	if err := fake.Exit(inst.InstanceID, 1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "restart after a failed start", func() bool {
+		s := serviceState(sn, inst.InstanceID)
+		return s.Status == "running" && s.Restarts == 1
+	})
+}
+
+func TestServiceNodeHealthCheck(t *testing.T) {
+	p := echoProfile()
+	p.HealthCheck = &HealthCheck{Exec: []string{"true"}, IntervalSec: 1, Retries: 1}
+	sn, fake := newTestNode(t, p)
+
+	inst, err := sn.StartInstance("Echo", 18080, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "healthy", func() bool {
+		return serviceState(sn, inst.InstanceID).Health == HealthHealthy
+	})
+
+	fake.SetExecExitCode(inst.InstanceID, 1)
+	waitFor(t, "unhealthy", func() bool {
+		return serviceState(sn, inst.InstanceID).Health == HealthUnhealthy
+	})
+}
+
+func TestServiceNodeMetrics(t *testing.T) {
+	sn, fake := newTestNode(t, echoProfile())
+
+	inst, err := sn.StartInstance("Echo", 18080, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.SetStats(inst.InstanceID, ContainerStatsSample{
+		MemoryUsage: 256 << 20,
+		MemoryLimit: 1 << 30,
+		NetRxBytes:  1000,
+	})
+	sn.metrics.sampleAll(context.Background())
+
+	samples := sn.ServiceMetrics(inst.InstanceID, time.Minute)
+	if len(samples) != 1 {
+		t.Fatalf("%d samples", len(samples))
+	}
+	if s := samples[0]; s.MemoryPercent != 25 || s.NetRxBytes != 1000 {
+		t.Errorf("sample: %+v", s)
+	}
+}
+
+func TestServiceNodeEngineDown(t *testing.T) {
+	sn, fake := newTestNode(t)
+
+	fake.SetDown(true)
+	if msg := sn.StartService("web", "nginx:1", "8080"); !strings.Contains(msg, "not running") {
+		t.Errorf("StartService with the engine down: %q", msg)
+	}
+
+	fake.SetDown(false)
+	if msg := sn.StartService("web", "nginx:1", "8080"); msg != "service started" {
+		t.Errorf("StartService: %q", msg)
+	}
+}
+
+func TestVolumeNames(t *testing.T) {
+	for _, pair := range [][2][2]string{
+		{{"a_b", "c"}, {"a", "b_c"}},
+		{{"MinIO", "data"}, {"minio", "data"}},
+	} {
+		if x, y := volumeName(pair[0][0], pair[0][1]), volumeName(pair[1][0], pair[1][1]); x == y {
+			t.Errorf("%v and %v share volume %s", pair[0], pair[1], x)
+		}
+	}
+
+	// A volume from before the hash was added keeps being used by its own
+	// profile only.
+	sn, fake := newTestNode(t, echoProfile())
+	legacy := legacyVolumeName("MinIO", "data")
+	fake.CreateVolume(context.Background(), legacy, map[string]string{VolumeLabel: "true", ProfileLabel: "MinIO"})
+	if got := sn.namedVolume("MinIO", "data"); got != legacy {
+		t.Errorf("MinIO uses %s, want its legacy volume %s", got, legacy)
+	}
+	if got := sn.namedVolume("minio", "data"); got != volumeName("minio", "data") {
+		t.Errorf("minio uses %s", got)
+	}
+}
@@ -8,20 +8,64 @@ import (
 	"time"
 )
 
+const (
+	rateBucket  = 10 * time.Second
+	rateBuckets = 6 // one minute
+)
+
 type ServiceStats struct {
 	Requests   int64
 	Errors     int64
 	Bandwidth  int64
+	InFlight   int64
 	LastUpdate time.Time
 }
 
 type StatsManager struct {
 	mu    sync.RWMutex
 	stats map[string]*ServiceStats
+	rates map[string]*rateCounter
 }
 
 func NewStatsManager() *StatsManager {
-	return &StatsManager{stats: map[string]*ServiceStats{}}
+	return &StatsManager{
+		stats: map[string]*ServiceStats{},
+		rates: map[string]*rateCounter{},
+	}
+}
+
+// Begin records a request being served by a local service and returns the
+// func that ends it. Unlike RecordRequest, which the routing node calls for
+// the endpoint it picked, this counts what the hosting node actually
+// handles, so it feeds the load we announce.
+func (sm *StatsManager) Begin(service string) func() {
+	sm.mu.Lock()
+	sm.ensure(service).InFlight++
+	r, ok := sm.rates[service]
+	if !ok {
+		r = &rateCounter{}
+		sm.rates[service] = r
+	}
+	r.add(time.Now())
+	sm.mu.Unlock()
+
+	return func() {
+		sm.mu.Lock()
+		sm.ensure(service).InFlight--
+		sm.mu.Unlock()
+	}
+}
+
+// Rate returns the requests per minute a local service served over the
+// last minute.
+func (sm *StatsManager) Rate(service string) float64 {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	r, ok := sm.rates[service]
+	if !ok {
+		return 0
+	}
+	return float64(r.sum(time.Now())) * float64(time.Minute) / float64(rateBucket*rateBuckets)
 }
 
 func (sm *StatsManager) RecordRequest(service string, bytes int64) {
@@ -59,3 +103,34 @@ func (sm *StatsManager) Snapshot() map[string]ServiceStats {
 	}
 	return out
 }
+
+// --------------------------
+// Request rate
+// --------------------------
+
+// rateCounter counts events in rateBuckets buckets of rateBucket each.
+type rateCounter struct {
+	counts [rateBuckets]int64
+	epochs [rateBuckets]int64
+}
+
+func (r *rateCounter) add(now time.Time) {
+	epoch := now.UnixNano() / int64(rateBucket)
+	i := epoch % rateBuckets
+	if r.epochs[i] != epoch {
+		r.epochs[i] = epoch
+		r.counts[i] = 0
+	}
+	r.counts[i]++
+}
+
+func (r *rateCounter) sum(now time.Time) int64 {
+	epoch := now.UnixNano() / int64(rateBucket)
+	var n int64
+	for i := range r.counts {
+		if epoch-r.epochs[i] < rateBuckets {
+			n += r.counts[i]
+		}
+	}
+	return n
+}
@@ -0,0 +1,271 @@
+// ==========================
+// supervisor.go
+// ==========================
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Restart modes for RestartPolicy.Mode.
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// Supervision states reported on Service.RestartState.
+const (
+	RestartStateRestarting = "restarting"
+	RestartStateCrashLoop  = "crash-loop"
+	RestartStateFailed     = "failed"
+)
+
+const (
+	minRestartBackoff = time.Second
+	maxRestartBackoff = 5 * time.Minute
+
+	// A service that keeps running this long is considered stable again and
+	// its backoff starts over.
+	stableRunTime = time.Minute
+
+	// crashLoopRestarts restarts within crashLoopWindow mean the service is
+	// crash looping; it is then only retried at maxRestartBackoff.
+	crashLoopRestarts = 5
+	crashLoopWindow   = 5 * time.Minute
+)
+
+// RestartPolicy says what the supervisor does when a service's container
+// exits without being stopped through undocked. MaxRetries limits
+// consecutive on-failure restarts; 0 means no limit.
+type RestartPolicy struct {
+	Mode       string `json:"mode"`
+	MaxRetries int    `json:"maxRetries,omitempty"`
+}
+
+func (p RestartPolicy) shouldRestart(exitCode int) bool {
+	switch p.Mode {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return exitCode != 0
+	default:
+		return false
+	}
+}
+
+// restartState tracks supervision of one service across restarts.
+type restartState struct {
+	restarts  int
+	attempts  int
+	lastExit  int
+	lastStart time.Time
+	recent    []time.Time
+	state     string
+	policy    RestartPolicy
+	service   Service
+	timer     *time.Timer
+}
+
+// RestartEvent is emitted as "service-restart" whenever the supervisor
+// acts on an exit.
+type RestartEvent struct {
+	ServiceID string `json:"serviceID"`
+	ExitCode  int    `json:"exitCode"`
+	Restarts  int    `json:"restarts"`
+	State     string `json:"state"`
+	DelayMs   int64  `json:"delayMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+func restartBackoff(attempt int) time.Duration {
+	d := minRestartBackoff
+	for i := 1; i < attempt && d < maxRestartBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxRestartBackoff)
+}
+
+// markStopping records that serviceID is being stopped on purpose, so its
+// exit isn't treated as a crash.
+func (sn *ServiceNode) markStopping(serviceID string) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	sn.stopping[serviceID] = struct{}{}
+	if st, ok := sn.restarts[serviceID]; ok {
+		if st.timer != nil {
+			st.timer.Stop()
+		}
+		delete(sn.restarts, serviceID)
+	}
+}
+
+// superviseExit applies the service's restart policy to a die event.
+func (sn *ServiceNode) superviseExit(ev ContainerEvent) {
+	name := ev.Name
+
+	sn.mu.Lock()
+	if _, ok := sn.stopping[name]; ok {
+		delete(sn.stopping, name)
+		sn.mu.Unlock()
+		return
+	}
+	last, known := sn.services[name]
+	sn.mu.Unlock()
+
+	profile, ok := sn.config.Get(ev.Labels[ProfileLabel])
+	if !ok || profile.RestartPolicy == nil || !profile.RestartPolicy.shouldRestart(ev.ExitCode) {
+		return
+	}
+	policy := *profile.RestartPolicy
+
+	// The event can arrive after stopAndRemove has cleared sn.stopping;
+	// a container that is gone was removed on purpose.
+	ctx, cancel := engineCtx()
+	_, err := sn.backend.InspectContainer(ctx, name)
+	cancel()
+	if errors.Is(err, ErrContainerNotFound) {
+		return
+	}
+
+	sn.mu.Lock()
+	st, ok := sn.restarts[name]
+	if !ok {
+		st = &restartState{}
+		sn.restarts[name] = st
+	}
+	if known {
+		st.service = last
+	}
+	st.lastExit = ev.ExitCode
+	st.policy = policy
+
+	if !st.lastStart.IsZero() && time.Since(st.lastStart) > stableRunTime {
+		st.attempts = 0
+	}
+
+	restartEv := sn.scheduleRestart(name, st)
+	sn.mu.Unlock()
+
+	sn.emitRestart(restartEv)
+}
+
+// scheduleRestart counts another failure of name and either arms the
+// restart timer or, past the policy's retry limit, gives up. Callers hold
+// sn.mu.
+func (sn *ServiceNode) scheduleRestart(name string, st *restartState) RestartEvent {
+	policy := st.policy
+	if policy.Mode == RestartOnFailure && policy.MaxRetries > 0 && st.attempts >= policy.MaxRetries {
+		st.state = RestartStateFailed
+		return sn.restartEvent(name, st, 0)
+	}
+
+	now := time.Now()
+	st.attempts++
+	st.recent = append(st.recent, now)
+	for len(st.recent) > 0 && now.Sub(st.recent[0]) > crashLoopWindow {
+		st.recent = st.recent[1:]
+	}
+
+	delay := restartBackoff(st.attempts)
+	st.state = RestartStateRestarting
+	if len(st.recent) >= crashLoopRestarts {
+		st.state = RestartStateCrashLoop
+		delay = maxRestartBackoff
+	}
+
+	st.timer = time.AfterFunc(delay, func() {
+		sn.restartService(name)
+	})
+	return sn.restartEvent(name, st, delay)
+}
+
+func (sn *ServiceNode) restartService(name string) {
+	if sn.ctx.Err() != nil {
+		return
+	}
+
+	sn.mu.Lock()
+	st, ok := sn.restarts[name]
+	sn.mu.Unlock()
+	if !ok {
+		return // stopped on purpose while we were waiting
+	}
+
+	err := sn.startContainer(name)
+
+	sn.mu.Lock()
+	if sn.restarts[name] != st {
+		sn.mu.Unlock()
+		return // stopped on purpose while starting
+	}
+	var ev RestartEvent
+	switch {
+	case errors.Is(err, ErrContainerNotFound):
+		// Removed outside undocked; there is nothing left to start.
+		st.state = RestartStateFailed
+		ev = sn.restartEvent(name, st, 0)
+	case err != nil:
+		// A failed start (engine timeout, port still bound, ...) is one
+		// more failure and goes through the same backoff and retry limit.
+		ev = sn.scheduleRestart(name, st)
+	default:
+		st.restarts++
+		st.lastStart = time.Now()
+		if st.state != RestartStateCrashLoop {
+			st.state = ""
+		}
+		ev = sn.restartEvent(name, st, 0)
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	sn.mu.Unlock()
+
+	sn.emitRestart(ev)
+	sn.refreshServices()
+	sn.BroadcastServices()
+}
+
+// restartEvent snapshots st; callers hold sn.mu.
+func (sn *ServiceNode) restartEvent(name string, st *restartState, delay time.Duration) RestartEvent {
+	return RestartEvent{
+		ServiceID: name,
+		ExitCode:  st.lastExit,
+		Restarts:  st.restarts,
+		State:     st.state,
+		DelayMs:   delay.Milliseconds(),
+	}
+}
+
+func (sn *ServiceNode) emitRestart(ev RestartEvent) {
+	sn.emit("service-restart", ev)
+}
+
+// applyRestartState folds supervision state into a freshly listed set of
+// services. Supervised services that are down waiting for a restart (or
+// given up on) stay listed with their restart state as status. Callers
+// hold sn.mu.
+func (sn *ServiceNode) applyRestartState(services map[string]Service) {
+	for id, st := range sn.restarts {
+		if s, ok := services[id]; ok {
+			if st.state == RestartStateCrashLoop && time.Since(st.lastStart) > stableRunTime {
+				st.state = ""
+			}
+			s.Restarts = st.restarts
+			s.RestartState = st.state
+			services[id] = s
+			continue
+		}
+		if st.state == "" || st.service.ServiceID == "" {
+			continue
+		}
+		s := st.service
+		s.Status = st.state
+		s.Restarts = st.restarts
+		s.RestartState = st.state
+		services[id] = s
+	}
+}
@@ -0,0 +1,160 @@
+// ==========================
+// validator.go
+// ==========================
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	maxAnnouncementSize     = 128 << 10
+	maxAnnouncementServices = 256
+
+	// Announcements older than this are replays; ones further ahead than
+	// announcementClockSkew come from a broken or lying clock.
+	maxAnnouncementAge    = 5 * time.Minute
+	announcementClockSkew = time.Minute
+
+	rejectLogInterval = 10 * time.Second
+)
+
+// Peer scoring: every rejected announcement a peer forwards costs it
+// (count² × invalidDeliveryWeight), decaying over an hour. A few bad
+// messages stop us gossiping with it, more stop us accepting its
+// messages at all.
+const (
+	invalidDeliveryWeight = -10
+	gossipThreshold       = -10
+	publishThreshold      = -50
+	graylistThreshold     = -80
+)
+
+// announcementScoring enables GossipSub peer scoring for the announcement
+// topics. Only invalid deliveries count; topics opt in via
+// topicScoreParams when they are joined.
+func announcementScoring() pubsub.Option {
+	params := &pubsub.PeerScoreParams{
+		Topics:           map[string]*pubsub.TopicScoreParams{},
+		AppSpecificScore: func(peer.ID) float64 { return 0 },
+		DecayInterval:    pubsub.DefaultDecayInterval,
+		DecayToZero:      0.01,
+		RetainScore:      time.Hour,
+
+		SkipAtomicValidation: true,
+	}
+	thresholds := &pubsub.PeerScoreThresholds{
+		GossipThreshold:   gossipThreshold,
+		PublishThreshold:  publishThreshold,
+		GraylistThreshold: graylistThreshold,
+
+		SkipAtomicValidation: true,
+	}
+	return pubsub.WithPeerScore(params, thresholds)
+}
+
+func topicScoreParams() *pubsub.TopicScoreParams {
+	return &pubsub.TopicScoreParams{
+		TopicWeight:                    1,
+		TimeInMeshQuantum:              time.Second, // unused, but must not be zero
+		InvalidMessageDeliveriesWeight: invalidDeliveryWeight,
+		InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(time.Hour),
+
+		SkipAtomicValidation: true,
+	}
+}
+
+// announcementValidator checks every message on one of ch's topics before
+// it is delivered or forwarded; legacy is set for the JSON topic. Messages
+// are already signed by their author (StrictSign); on top of that the
+// message must be well-formed, fresh, and about the peer that signed it.
+// Rejected messages count against the peer that sent them to us, and are
+// logged at most once per rejectLogInterval so a flood can't fill the
+// log. Accepted ones carry the decoded wireMessage as ValidatorData.
+func (sn *ServiceNode) announcementValidator(ch *gossipChannel, legacy bool) pubsub.ValidatorEx {
+	var (
+		mu         sync.Mutex
+		lastLog    time.Time
+		suppressed int
+	)
+
+	return func(_ context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		now := time.Now()
+		m, err := decodeAnnouncement(ch, msg, now)
+		if err == nil && m.legacy != legacy {
+			err = errors.New("wrong format for the topic")
+		}
+		if err != nil {
+			if from == sn.host.ID() {
+				return pubsub.ValidationReject
+			}
+
+			mu.Lock()
+			if now.Sub(lastLog) < rejectLogInterval {
+				suppressed++
+				mu.Unlock()
+				return pubsub.ValidationReject
+			}
+			n := suppressed
+			lastLog, suppressed = now, 0
+			mu.Unlock()
+
+			if n > 0 {
+				fmt.Printf("Rejected announcement from %s: %v (%d more since the last report)\n", from, err, n)
+			} else {
+				fmt.Printf("Rejected announcement from %s: %v\n", from, err)
+			}
+			return pubsub.ValidationReject
+		}
+		msg.ValidatorData = m
+		return pubsub.ValidationAccept
+	}
+}
+
+func decodeAnnouncement(ch *gossipChannel, msg *pubsub.Message, now time.Time) (wireMessage, error) {
+	if len(msg.Data) > maxAnnouncementSize {
+		return wireMessage{}, fmt.Errorf("%d bytes is too large", len(msg.Data))
+	}
+
+	data := msg.Data
+	if ch.group != nil {
+		var err error
+		if data, err = ch.group.open(data); err != nil {
+			return wireMessage{}, errors.New("not sealed with the group key")
+		}
+	}
+
+	m, err := unmarshalWire(data)
+	if err != nil {
+		return m, fmt.Errorf("malformed: %w", err)
+	}
+
+	id, err := peer.Decode(m.PeerID)
+	if err != nil {
+		return m, fmt.Errorf("malformed peer ID: %w", err)
+	}
+	if id != msg.GetFrom() {
+		return m, fmt.Errorf("signed by %s but claims to be %s", msg.GetFrom(), id)
+	}
+
+	if now.Sub(m.Time) > maxAnnouncementAge || m.Time.Sub(now) > announcementClockSkew {
+		return m, fmt.Errorf("stale timestamp %s", m.Time.Format(time.RFC3339))
+	}
+
+	if len(m.Services)+len(m.Withdrawn) > maxAnnouncementServices {
+		return m, fmt.Errorf("%d services is too many", len(m.Services)+len(m.Withdrawn))
+	}
+	for _, s := range m.Services {
+		if s.ServiceID == "" {
+			return m, errors.New("service without an ID")
+		}
+	}
+	return m, nil
+}
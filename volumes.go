@@ -0,0 +1,190 @@
+// ==========================
+// volumes.go
+// ==========================
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VolumeLabel marks volumes undocked created. Only those are listed or
+// deleted through the app.
+const VolumeLabel = "undocked.volume"
+
+// volumeName namespaces a profile's named volume, e.g.
+// undocked_minio_data_1a2b3c4d. The slugs keep it readable; the hash of the
+// exact (profile, name) pair keeps names that slug alike, such as "MinIO"
+// and "minio" or "a_b"/"c" and "a"/"b_c", apart.
+func volumeName(profile, name string) string {
+	sum := sha256.Sum256([]byte(profile + "\x00" + name))
+	return "undocked_" + slug(profile) + "_" + slug(name) + "_" + hex.EncodeToString(sum[:4])
+}
+
+// legacyVolumeName is the name volumes had before volumeName added a hash.
+func legacyVolumeName(profile, name string) string {
+	return "undocked_" + slug(profile) + "_" + slug(name)
+}
+
+// namedVolume picks the volume for a profile's named mount. A volume
+// created under the legacy name for this same profile keeps being used so
+// its data isn't left behind.
+func (sn *ServiceNode) namedVolume(profile, name string) string {
+	ctx, cancel := engineCtx()
+	defer cancel()
+
+	current := volumeName(profile, name)
+	if _, err := sn.backend.InspectVolume(ctx, current); err == nil {
+		return current
+	}
+	legacy, err := sn.backend.InspectVolume(ctx, legacyVolumeName(profile, name))
+	if err == nil && legacy.Labels[VolumeLabel] == "true" && legacy.Labels[ProfileLabel] == profile {
+		return legacy.Name
+	}
+	return current
+}
+
+func slug(s string) string {
+	return strings.Trim(unsafeFileChars.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// profileMounts creates the profile's named volumes if needed and resolves
+// its bind mounts to absolute host paths.
+func (sn *ServiceNode) profileMounts(profile ServiceProfile) ([]Mount, error) {
+	mounts := make([]Mount, 0, len(profile.Volumes))
+
+	for _, v := range profile.Volumes {
+		if v.Target == "" {
+			return nil, fmt.Errorf("volume %q has no target", v.Name)
+		}
+
+		switch {
+		case v.HostPath != "":
+			src, err := expandHostPath(v.HostPath)
+			if err != nil {
+				return nil, err
+			}
+			if err := os.MkdirAll(src, 0o755); err != nil {
+				return nil, err
+			}
+			mounts = append(mounts, Mount{Type: "bind", Source: src, Target: v.Target, ReadOnly: v.ReadOnly})
+
+		case v.Name != "":
+			name := sn.namedVolume(profile.Name, v.Name)
+			ctx, cancel := engineCtx()
+			_, err := sn.backend.CreateVolume(ctx, name, map[string]string{
+				VolumeLabel:  "true",
+				ProfileLabel: profile.Name,
+			})
+			cancel()
+			if err != nil {
+				return nil, err
+			}
+			mounts = append(mounts, Mount{Type: "volume", Source: name, Target: v.Target, ReadOnly: v.ReadOnly})
+
+		default:
+			return nil, fmt.Errorf("volume for %s needs a name or hostPath", v.Target)
+		}
+	}
+
+	return mounts, nil
+}
+
+func expandHostPath(p string) (string, error) {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		p = filepath.Join(home, p[1:])
+	}
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("bind mount path %q must be absolute", p)
+	}
+	return filepath.Clean(p), nil
+}
+
+// --------------------------
+// Management
+// --------------------------
+
+func (sn *ServiceNode) ListVolumes() ([]VolumeInfo, error) {
+	ctx, cancel := engineCtx()
+	defer cancel()
+
+	vols, err := sn.backend.ListVolumes(ctx, map[string]string{VolumeLabel: "true"})
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := sn.volumeUsers()
+	if err != nil {
+		return nil, err
+	}
+	for i := range vols {
+		vols[i].UsedBy = users[vols[i].Name]
+	}
+	return vols, nil
+}
+
+func (sn *ServiceNode) InspectVolume(name string) (VolumeInfo, error) {
+	ctx, cancel := engineCtx()
+	defer cancel()
+
+	v, err := sn.backend.InspectVolume(ctx, name)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+	if v.Labels[VolumeLabel] != "true" {
+		return VolumeInfo{}, fmt.Errorf("%w: %s", ErrVolumeNotFound, name)
+	}
+
+	users, err := sn.volumeUsers()
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+	v.UsedBy = users[name]
+	return v, nil
+}
+
+// DeleteVolume removes an undocked volume and its data. Volumes still
+// attached to a service container are refused.
+func (sn *ServiceNode) DeleteVolume(name string) error {
+	v, err := sn.InspectVolume(name)
+	if err != nil {
+		return err
+	}
+	if len(v.UsedBy) > 0 {
+		return fmt.Errorf("volume %s is in use by %s", name, strings.Join(v.UsedBy, ", "))
+	}
+
+	ctx, cancel := engineCtx()
+	defer cancel()
+	return sn.backend.RemoveVolume(ctx, name, false)
+}
+
+// volumeUsers maps volume names to the undocked containers (running or
+// not) that mount them.
+func (sn *ServiceNode) volumeUsers() (map[string][]string, error) {
+	ctx, cancel := engineCtx()
+	defer cancel()
+
+	containers, err := sn.backend.ListContainers(ctx, map[string]string{ServiceLabel: "true"}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string][]string{}
+	for _, c := range containers {
+		for _, m := range c.Mounts {
+			if m.Type == "volume" {
+				users[m.Source] = append(users[m.Source], c.Name)
+			}
+		}
+	}
+	return users, nil
+}
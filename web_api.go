@@ -5,24 +5,107 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type WebAPI struct {
 	router *Router
+	node   *ServiceNode
 	config *ServiceConfigStore
 }
 
-func NewWebAPI(router *Router, config *ServiceConfigStore) *WebAPI {
-	return &WebAPI{router: router, config: config}
+func NewWebAPI(router *Router, node *ServiceNode) *WebAPI {
+	return &WebAPI{router: router, node: node, config: node.config}
 }
 
+// Register mounts the API on mux. Anything that changes state is
+// POST-only.
 func (api *WebAPI) Register(mux *http.ServeMux) {
-	mux.HandleFunc("/v1/services/recommended", api.listRecommended)
-	mux.HandleFunc("/v1/services/configure", api.configureService)
+	mux.HandleFunc("GET /v1/snapshot", api.snapshot)
+	mux.HandleFunc("GET /v1/services", api.listServices)
+	mux.HandleFunc("GET /v1/services/logs", api.serviceLogs)
+	mux.HandleFunc("GET /v1/services/profiles", api.listProfiles)
+	mux.HandleFunc("GET /v1/services/recommended", api.listRecommended)
+	mux.HandleFunc("POST /v1/services/configure", api.configureService)
+	mux.HandleFunc("GET /v1/services/schema", api.profileSchema)
+	mux.HandleFunc("GET /v1/services/instances", api.listInstances)
+	mux.HandleFunc("POST /v1/services/start", api.startService)
+	mux.HandleFunc("POST /v1/services/stop", api.stopService)
 	mux.HandleFunc("/v1/translate", api.router.handleHTTP)
-	mux.HandleFunc("/v1/stats", api.router.handleStats)
-	mux.HandleFunc("/v1/ban", api.router.handleBan)
+	mux.HandleFunc("/v1/proxy/{profile}/{path...}", api.router.handleProxy)
+	mux.HandleFunc("GET /v1/stats", api.router.handleStats)
+	mux.HandleFunc("POST /v1/ban", api.router.handleBan)
+	mux.HandleFunc("POST /v1/unban", api.router.handleUnban)
+	mux.HandleFunc("GET /v1/bans", api.router.handleBans)
+	mux.HandleFunc("GET /v1/peers", api.listPeers)
+	mux.HandleFunc("GET /v1/groups", api.listGroups)
+	mux.HandleFunc("POST /v1/groups/create", api.createGroup)
+	mux.HandleFunc("GET /v1/groups/invite", api.groupInvite)
+	mux.HandleFunc("POST /v1/groups/join", api.joinGroup)
+	mux.HandleFunc("POST /v1/groups/leave", api.leaveGroup)
+}
+
+func (api *WebAPI) snapshot(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(api.node.Snapshot())
+}
+
+func (api *WebAPI) listServices(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(api.node.ListServices())
+}
+
+func (api *WebAPI) listPeers(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(api.node.GetPeers())
+}
+
+func (api *WebAPI) listProfiles(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(api.config.List())
+}
+
+// serviceLogs returns the newest n stored lines for ?id= (n at most
+// maxLogLines). With ?since= (RFC 3339) it returns the oldest n lines after
+// that time instead, which lets clients poll to follow and page through
+// bursts.
+func (api *WebAPI) serviceLogs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("id")
+	if id == "" {
+		http.Error(w, "id is required", 400)
+		return
+	}
+
+	n := 100
+	if v := q.Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 || n > maxLogLines {
+			http.Error(w, "invalid n", 400)
+			return
+		}
+	}
+
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			http.Error(w, "invalid since", 400)
+			return
+		}
+	}
+
+	var lines []LogLine
+	var err error
+	if since.IsZero() {
+		lines, err = api.node.TailLogs(id, n)
+	} else {
+		lines, err = api.node.LogsSince(id, since, n)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(lines)
 }
 
 func (api *WebAPI) listRecommended(w http.ResponseWriter, _ *http.Request) {
@@ -37,11 +120,154 @@ func (api *WebAPI) listRecommended(w http.ResponseWriter, _ *http.Request) {
 }
 
 func (api *WebAPI) configureService(w http.ResponseWriter, r *http.Request) {
-	var profile ServiceProfile
-	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+	var raw map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
-	api.config.Add(profile)
+
+	profile, err := DecodeProfile(raw)
+	if err == nil {
+		err = api.config.Add(profile)
+	}
+
+	var ve *ValidationError
+	switch {
+	case errors.As(err, &ve):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(ve)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *WebAPI) profileSchema(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(ProfileSchema)
+}
+
+type startRequest struct {
+	ServiceID string            `json:"service_id"`
+	Port      int               `json:"port"`
+	Env       map[string]string `json:"env"`
+}
+
+type stopRequest struct {
+	InstanceID string `json:"instance_id"`
+}
+
+func (api *WebAPI) listInstances(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.node.ListInstances())
+}
+
+func (api *WebAPI) startService(w http.ResponseWriter, r *http.Request) {
+	var req startRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	inst, err := api.node.StartInstance(req.ServiceID, req.Port, req.Env)
+	switch {
+	case errors.Is(err, ErrProfileNotFound):
+		http.Error(w, err.Error(), 404)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inst)
+}
+
+func (api *WebAPI) stopService(w http.ResponseWriter, r *http.Request) {
+	var req stopRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if err := api.node.StopInstance(req.InstanceID); err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// --------------------------
+// Groups
+// --------------------------
+
+type groupRequest struct {
+	Name   string `json:"name,omitempty"`
+	Invite string `json:"invite,omitempty"`
+}
+
+func (api *WebAPI) listGroups(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(api.node.ListGroups())
+}
+
+// decodeGroupRequest reads a POSTed groupRequest, answering the error
+// itself when it fails.
+func decodeGroupRequest(w http.ResponseWriter, r *http.Request) (groupRequest, bool) {
+	var req groupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return req, false
+	}
+	return req, true
+}
+
+func (api *WebAPI) createGroup(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeGroupRequest(w, r)
+	if !ok {
+		return
+	}
+	invite, err := api.node.CreateGroup(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(groupRequest{Name: req.Name, Invite: invite})
+}
+
+func (api *WebAPI) groupInvite(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	invite, err := api.node.GroupInvite(name)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	json.NewEncoder(w).Encode(groupRequest{Name: name, Invite: invite})
+}
+
+func (api *WebAPI) joinGroup(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeGroupRequest(w, r)
+	if !ok {
+		return
+	}
+	g, err := api.node.JoinGroup(req.Invite)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(groupRequest{Name: g.Name})
+}
+
+func (api *WebAPI) leaveGroup(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeGroupRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := api.node.LeaveGroup(req.Name); err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,494 @@
+// ==========================
+// wire.go
+// ==========================
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Gossip messages are protobuf-encoded envelopes:
+//
+//	message Envelope {
+//	  uint32  version   = 1;  // wireVersion
+//	  Type    type      = 2;  // ANNOUNCE = 1, WITHDRAW = 2, HEARTBEAT = 3
+//	  string  peer_id   = 3;
+//	  int64   time_ms   = 4;  // when it was sent, Unix milliseconds
+//	  uint64  seq       = 5;  // sender's sequence number on this topic
+//	  uint64  base_seq  = 6;  // ANNOUNCE: the seq this delta applies to; 0 = full
+//	  repeated ServiceAd services  = 7;  // full list, or changed services
+//	  repeated string    withdrawn = 8;  // service IDs that went away
+//	  bool    goodbye   = 9;  // WITHDRAW: the sender is shutting down
+//	  bool    resync    = 10; // the sender missed messages; send it a full ANNOUNCE
+//	}
+//
+//	message ServiceAd {
+//	  string id = 1;  string profile = 2;  string image = 3;
+//	  string host_port = 4;  string status = 5;  string health = 6;
+//	  string started_at = 7;  uint32 weight = 8;  uint32 restarts = 9;
+//	  Load load = 10;
+//	}
+//
+//	message Load {
+//	  uint64 in_flight = 1;  uint32 rate_per_min = 2;
+//	  uint32 cpu_percent = 3;  uint32 memory_percent = 4;  uint32 capacity = 5;
+//	}
+//
+// Readers skip fields they don't know, so later versions can add fields
+// without breaking older nodes. Local-only counters (requests, errors,
+// bandwidth) are not sent. Load figures are rounded to whole units so an
+// idle service looks unchanged between heartbeats and stays out of deltas.
+//
+// Envelopes go on their own topics, the channel's name plus
+// wireTopicSuffix, so nodes from before the envelope never see them. Those
+// nodes publish a JSON PeerInfo on the public topic; we still listen there,
+// and while such peers are subscribed to it we publish JSON there too. A
+// change older readers can't skip gets a new suffix.
+const (
+	wireVersion     = 1
+	wireTopicSuffix = "/v1"
+)
+
+type wireType uint32
+
+const (
+	wireAnnounce  wireType = 1
+	wireWithdraw  wireType = 2
+	wireHeartbeat wireType = 3
+)
+
+type wireMessage struct {
+	Version   uint32
+	Type      wireType
+	PeerID    string
+	Time      time.Time
+	Seq       uint64
+	BaseSeq   uint64
+	Services  []Service
+	Withdrawn []string
+	Goodbye   bool
+	Resync    bool
+
+	// legacy is set for JSON announcements; compat for JSON that a current
+	// node sent alongside its envelope for older peers.
+	legacy bool
+	compat bool
+}
+
+// full reports whether m replaces everything the sender announced before.
+func (m wireMessage) full() bool {
+	return m.Type == wireAnnounce && m.BaseSeq == 0
+}
+
+// legacyAnnouncement is the pre-envelope JSON message. Wire marks copies
+// sent by nodes that also speak the envelope; old nodes ignore it.
+type legacyAnnouncement struct {
+	PeerInfo
+	Wire int `json:"wire,omitempty"`
+}
+
+// --------------------------
+// Encoding
+// --------------------------
+
+func (m wireMessage) marshal() []byte {
+	var b []byte
+	b = appendVarint(b, 1, uint64(wireVersion))
+	b = appendVarint(b, 2, uint64(m.Type))
+	b = appendString(b, 3, m.PeerID)
+	b = appendVarint(b, 4, uint64(m.Time.UnixMilli()))
+	b = appendVarint(b, 5, m.Seq)
+	b = appendVarint(b, 6, m.BaseSeq)
+	for _, s := range m.Services {
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalServiceAd(s))
+	}
+	for _, id := range m.Withdrawn {
+		b = protowire.AppendTag(b, 8, protowire.BytesType)
+		b = protowire.AppendString(b, id)
+	}
+	if m.Goodbye {
+		b = appendVarint(b, 9, 1)
+	}
+	if m.Resync {
+		b = appendVarint(b, 10, 1)
+	}
+	return b
+}
+
+// marshalServiceAd encodes what peers need to know about a service. The
+// encoding is deterministic, so equal bytes mean nothing worth
+// announcing has changed.
+func marshalServiceAd(s Service) []byte {
+	var b []byte
+	b = appendString(b, 1, s.ServiceID)
+	b = appendString(b, 2, s.Profile)
+	b = appendString(b, 3, s.DockerImage)
+	b = appendString(b, 4, s.HostPort)
+	b = appendString(b, 5, s.Status)
+	b = appendString(b, 6, s.Health)
+	b = appendString(b, 7, s.StartedAt)
+	b = appendVarint(b, 8, uint64(max(s.Weight, 0)))
+	b = appendVarint(b, 9, uint64(max(s.Restarts, 0)))
+	if l := s.Load; l != nil {
+		var lb []byte
+		lb = appendVarint(lb, 1, uint64(max(l.InFlight, 0)))
+		lb = appendVarint(lb, 2, roundUnits(l.RatePerMin))
+		lb = appendVarint(lb, 3, roundUnits(l.CPUPercent))
+		lb = appendVarint(lb, 4, roundUnits(l.MemoryPercent))
+		lb = appendVarint(lb, 5, uint64(max(l.Capacity, 0)))
+		b = protowire.AppendTag(b, 10, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+	return b
+}
+
+func roundUnits(f float64) uint64 {
+	if f <= 0 || math.IsNaN(f) {
+		return 0
+	}
+	return uint64(math.Round(math.Min(f, math.MaxUint32)))
+}
+
+// appendVarint and appendString leave out zero values, as proto3 does.
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// --------------------------
+// Decoding
+// --------------------------
+
+var errWireTruncated = errors.New("truncated message")
+
+// unmarshalWire decodes an envelope, or a legacy JSON announcement.
+func unmarshalWire(data []byte) (wireMessage, error) {
+	if len(data) > 0 && data[0] == '{' {
+		return unmarshalLegacy(data)
+	}
+
+	var m wireMessage
+	err := walkFields(data, func(num protowire.Number, v uint64, raw []byte) error {
+		switch num {
+		case 1:
+			m.Version = uint32(v)
+		case 2:
+			m.Type = wireType(v)
+		case 3:
+			m.PeerID = string(raw)
+		case 4:
+			m.Time = time.UnixMilli(int64(v))
+		case 5:
+			m.Seq = v
+		case 6:
+			m.BaseSeq = v
+		case 7:
+			s, err := unmarshalServiceAd(raw)
+			if err != nil {
+				return err
+			}
+			m.Services = append(m.Services, s)
+		case 8:
+			m.Withdrawn = append(m.Withdrawn, string(raw))
+		case 9:
+			m.Goodbye = v != 0
+		case 10:
+			m.Resync = v != 0
+		}
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+
+	if m.Version == 0 {
+		return m, errors.New("missing version")
+	}
+	switch m.Type {
+	case wireAnnounce, wireWithdraw, wireHeartbeat:
+	default:
+		return m, fmt.Errorf("unknown message type %d", m.Type)
+	}
+	return m, nil
+}
+
+func unmarshalLegacy(data []byte) (wireMessage, error) {
+	var a legacyAnnouncement
+	if err := json.Unmarshal(data, &a); err != nil {
+		return wireMessage{}, err
+	}
+	sent, err := time.Parse(time.RFC3339, a.LastSeen)
+	if err != nil {
+		return wireMessage{}, fmt.Errorf("malformed timestamp: %w", err)
+	}
+	return wireMessage{
+		Type:     wireAnnounce,
+		PeerID:   a.ID,
+		Time:     sent,
+		Services: a.Services,
+		legacy:   true,
+		compat:   a.Wire > 0,
+	}, nil
+}
+
+func unmarshalServiceAd(data []byte) (Service, error) {
+	var s Service
+	err := walkFields(data, func(num protowire.Number, v uint64, raw []byte) error {
+		switch num {
+		case 1:
+			s.ServiceID = string(raw)
+		case 2:
+			s.Profile = string(raw)
+		case 3:
+			s.DockerImage = string(raw)
+		case 4:
+			s.HostPort = string(raw)
+		case 5:
+			s.Status = string(raw)
+		case 6:
+			s.Health = string(raw)
+		case 7:
+			s.StartedAt = string(raw)
+		case 8:
+			s.Weight = int(min(v, math.MaxInt32))
+		case 9:
+			s.Restarts = int(min(v, math.MaxInt32))
+		case 10:
+			l, err := unmarshalLoad(raw)
+			if err != nil {
+				return err
+			}
+			s.Load = &l
+			s.ActiveConns = int(l.InFlight)
+		}
+		return nil
+	})
+	return s, err
+}
+
+func unmarshalLoad(data []byte) (ServiceLoad, error) {
+	var l ServiceLoad
+	err := walkFields(data, func(num protowire.Number, v uint64, _ []byte) error {
+		switch num {
+		case 1:
+			l.InFlight = int64(min(v, math.MaxInt32))
+		case 2:
+			l.RatePerMin = float64(v)
+		case 3:
+			l.CPUPercent = float64(v)
+		case 4:
+			l.MemoryPercent = float64(v)
+		case 5:
+			l.Capacity = int(min(v, math.MaxInt32))
+		}
+		return nil
+	})
+	return l, err
+}
+
+// walkFields calls fn for every field in a protobuf message with its
+// varint value or its bytes, skipping fields of other wire types.
+func walkFields(data []byte, fn func(num protowire.Number, v uint64, raw []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return errWireTruncated
+		}
+		data = data[n:]
+
+		var (
+			v   uint64
+			raw []byte
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			raw, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			num = 0
+		}
+		if n < 0 {
+			return errWireTruncated
+		}
+		data = data[n:]
+
+		if num == 0 {
+			continue
+		}
+		if err := fn(num, v, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --------------------------
+// Sender and receiver state
+// --------------------------
+
+// Senders publish a full announcement every fullAnnounceEvery heartbeats
+// and deltas in between; a heartbeat when nothing changed. Every message
+// carries the sender's sequence number, so a receiver notices when it
+// missed one and sets resync on its own next message; whoever sees that
+// sends a full announcement next. Deltas carry whole services, so until
+// then the receiver is only out of date, not wrong about what it has.
+const fullAnnounceEvery = 10
+
+// announcer tracks what we last told one topic.
+type announcer struct {
+	sent      map[string]string // service ID -> encoded ad
+	seq       uint64
+	sinceFull int
+	wantFull  bool // someone needs everything: send a full announcement
+	resync    bool // we missed something: ask for full announcements
+	closed    bool // after our goodbye nothing more is sent
+}
+
+// next returns the message that brings the topic up to date with
+// services.
+func (a *announcer) next(peerID string, services []Service, now time.Time) wireMessage {
+	if a.seq == 0 {
+		// Start above anything a previous run of this node sent, so
+		// receivers don't take our messages for stale ones.
+		a.seq = uint64(now.UnixMilli())
+	}
+
+	ads := make(map[string]string, len(services))
+	for _, s := range services {
+		ads[s.ServiceID] = string(marshalServiceAd(s))
+	}
+
+	m := wireMessage{Type: wireAnnounce, PeerID: peerID, Time: now, Resync: a.resync}
+	a.resync = false
+	if a.sent == nil || a.wantFull || a.sinceFull >= fullAnnounceEvery {
+		m.Services = services
+		a.sinceFull, a.wantFull = 0, false
+	} else {
+		for _, s := range services {
+			if a.sent[s.ServiceID] != ads[s.ServiceID] {
+				m.Services = append(m.Services, s)
+			}
+		}
+		for id := range a.sent {
+			if _, ok := ads[id]; !ok {
+				m.Withdrawn = append(m.Withdrawn, id)
+			}
+		}
+		sort.Strings(m.Withdrawn)
+		a.sinceFull++
+
+		if len(m.Services) == 0 && len(m.Withdrawn) == 0 {
+			m.Type = wireHeartbeat
+			m.Seq = a.seq
+			a.sent = ads
+			return m
+		}
+		m.BaseSeq = a.seq
+	}
+
+	a.seq++
+	m.Seq = a.seq
+	a.sent = ads
+	return m
+}
+
+// withdraw returns a message taking ids off the topic, or false when none
+// of them were announced there. A goodbye withdraws everything and closes
+// the announcer.
+func (a *announcer) withdraw(peerID string, ids []string, goodbye bool, now time.Time) (wireMessage, bool) {
+	if a.sent == nil || a.closed {
+		a.closed = a.closed || goodbye
+		return wireMessage{}, false
+	}
+	a.closed = goodbye
+
+	m := wireMessage{Type: wireWithdraw, PeerID: peerID, Time: now, Goodbye: goodbye}
+	if goodbye {
+		ids = make([]string, 0, len(a.sent))
+		for id := range a.sent {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		if _, ok := a.sent[id]; ok {
+			m.Withdrawn = append(m.Withdrawn, id)
+			delete(a.sent, id)
+		}
+	}
+	if len(m.Withdrawn) == 0 && !goodbye {
+		return m, false
+	}
+	sort.Strings(m.Withdrawn)
+
+	m.BaseSeq = a.seq
+	a.seq++
+	m.Seq = a.seq
+	return m, true
+}
+
+// peerView is what one peer has announced on one topic.
+type peerView struct {
+	services []Service // sorted by service ID
+	seq      uint64
+}
+
+// apply folds m into the view and reports a gap: a heartbeat ahead of
+// the view, or a change based on a sequence number the view isn't at.
+// Changes no newer than the view are ignored; heartbeats change nothing.
+func (v *peerView) apply(m wireMessage) (gap bool) {
+	if m.Type == wireHeartbeat {
+		return m.Seq > v.seq
+	}
+	if !m.legacy {
+		if m.Seq <= v.seq {
+			return false
+		}
+		gap = !m.full() && m.BaseSeq != v.seq
+		v.seq = m.Seq
+	}
+
+	switch {
+	case m.full() || m.legacy:
+		v.services = append([]Service(nil), m.Services...)
+	default:
+		byID := make(map[string]Service, len(v.services))
+		for _, s := range v.services {
+			byID[s.ServiceID] = s
+		}
+		for _, s := range m.Services {
+			byID[s.ServiceID] = s
+		}
+		for _, id := range m.Withdrawn {
+			delete(byID, id)
+		}
+		v.services = v.services[:0:0]
+		for _, s := range byID {
+			v.services = append(v.services, s)
+		}
+	}
+	sort.Slice(v.services, func(i, j int) bool {
+		return v.services[i].ServiceID < v.services[j].ServiceID
+	})
+	return gap
+}
@@ -0,0 +1,305 @@
+// ==========================
+// wire_test.go
+// ==========================
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func testService(id, status string) Service {
+	return Service{
+		ServiceID:   id,
+		Profile:     "Whoami",
+		DockerImage: "traefik/whoami:latest",
+		HostPort:    "18080",
+		Status:      status,
+		Health:      "healthy",
+		StartedAt:   "2025-01-02T03:04:05Z",
+		Weight:      2,
+		Restarts:    1,
+		ActiveConns: 3,
+		Load:        &ServiceLoad{InFlight: 3, RatePerMin: 40, CPUPercent: 12, MemoryPercent: 30, Capacity: 8},
+	}
+}
+
+func TestWireRoundTrip(t *testing.T) {
+	now := time.UnixMilli(time.Now().UnixMilli())
+	msgs := map[string]wireMessage{
+		"full": {
+			Type: wireAnnounce, PeerID: "peer", Time: now, Seq: 7,
+			Services: []Service{testService("a", "running"), {ServiceID: "b"}},
+		},
+		"delta": {
+			Type: wireAnnounce, PeerID: "peer", Time: now, Seq: 8, BaseSeq: 7,
+			Services: []Service{testService("a", "exited")}, Withdrawn: []string{"b"},
+		},
+		"heartbeat": {Type: wireHeartbeat, PeerID: "peer", Time: now, Seq: 8, Resync: true},
+		"goodbye": {
+			Type: wireWithdraw, PeerID: "peer", Time: now, Seq: 9, BaseSeq: 8,
+			Withdrawn: []string{"a"}, Goodbye: true,
+		},
+	}
+
+	for name, m := range msgs {
+		got, err := unmarshalWire(m.marshal())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		m.Version = wireVersion
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("%s: got %+v, want %+v", name, got, m)
+		}
+	}
+}
+
+// Newer versions may add fields; readers must skip them.
+func TestWireSkipsUnknownFields(t *testing.T) {
+	m := wireMessage{Type: wireHeartbeat, PeerID: "peer", Seq: 3}
+	data := m.marshal()
+	data = protowire.AppendTag(data, 99, protowire.VarintType)
+	data = protowire.AppendVarint(data, 1)
+	data = protowire.AppendTag(data, 98, protowire.BytesType)
+	data = protowire.AppendString(data, "future")
+	data = protowire.AppendTag(data, 97, protowire.Fixed32Type)
+	data = protowire.AppendFixed32(data, 5)
+
+	got, err := unmarshalWire(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != wireHeartbeat || got.PeerID != "peer" || got.Seq != 3 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestWireRejectsMalformed(t *testing.T) {
+	valid := wireMessage{Type: wireAnnounce, PeerID: "peer", Seq: 1}.marshal()
+
+	var noVersion []byte
+	noVersion = appendVarint(noVersion, 2, uint64(wireAnnounce))
+
+	var badType []byte
+	badType = appendVarint(badType, 1, wireVersion)
+	badType = appendVarint(badType, 2, 42)
+
+	for name, data := range map[string][]byte{
+		"truncated":  valid[:len(valid)-1],
+		"no version": noVersion,
+		"bad type":   badType,
+		"bad json":   []byte("{not json"),
+	} {
+		if _, err := unmarshalWire(data); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestWireLegacy(t *testing.T) {
+	old := []byte(`{"id":"peer","services":[{"serviceID":"a"}],"lastSeen":"2025-01-02T03:04:05Z"}`)
+	m, err := unmarshalWire(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.legacy || m.compat || m.Type != wireAnnounce || len(m.Services) != 1 {
+		t.Errorf("old node: got %+v", m)
+	}
+
+	compat := []byte(`{"id":"peer","services":[],"lastSeen":"2025-01-02T03:04:05Z","wire":1}`)
+	if m, err = unmarshalWire(compat); err != nil || !m.compat {
+		t.Errorf("compat copy: got %+v, %v", m, err)
+	}
+}
+
+// --------------------------
+// Sender and receiver state
+// --------------------------
+
+// deliver encodes m and applies it to v as a receiver would.
+func deliver(t *testing.T, v *peerView, m wireMessage) bool {
+	t.Helper()
+	got, err := unmarshalWire(m.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.apply(got)
+}
+
+func serviceIDs(services []Service) []string {
+	ids := []string{}
+	for _, s := range services {
+		ids = append(ids, s.ServiceID)
+	}
+	return ids
+}
+
+func TestAnnouncerDeltas(t *testing.T) {
+	var a announcer
+	var v peerView
+	now := time.Now()
+	a1, b1 := testService("a", "running"), testService("b", "running")
+
+	m := a.next("peer", []Service{a1, b1}, now)
+	if !m.full() {
+		t.Fatal("first announcement is not full")
+	}
+	deliver(t, &v, m)
+
+	b2 := testService("b", "exited")
+	m = a.next("peer", []Service{a1, b2}, now)
+	if m.full() || !reflect.DeepEqual(serviceIDs(m.Services), []string{"b"}) {
+		t.Fatalf("delta carries %v", serviceIDs(m.Services))
+	}
+	if deliver(t, &v, m) {
+		t.Error("gap reported for an in-order delta")
+	}
+	if v.services[1].Status != "exited" {
+		t.Errorf("delta not applied: %+v", v.services[1])
+	}
+
+	m = a.next("peer", []Service{a1}, now)
+	if !reflect.DeepEqual(m.Withdrawn, []string{"b"}) {
+		t.Fatalf("withdrawn %v", m.Withdrawn)
+	}
+	deliver(t, &v, m)
+
+	m = a.next("peer", []Service{a1}, now)
+	if m.Type != wireHeartbeat {
+		t.Fatalf("unchanged services sent as %v", m.Type)
+	}
+	if deliver(t, &v, m) {
+		t.Error("gap reported for an up-to-date heartbeat")
+	}
+
+	m, ok := a.withdraw("peer", []string{"a"}, false, now)
+	if !ok {
+		t.Fatal("withdraw sent nothing")
+	}
+	deliver(t, &v, m)
+	if len(v.services) != 0 {
+		t.Errorf("view still holds %v", serviceIDs(v.services))
+	}
+	if _, ok := a.withdraw("peer", []string{"a"}, false, now); ok {
+		t.Error("withdrew a service twice")
+	}
+}
+
+func TestAnnouncerFullEvery(t *testing.T) {
+	var a announcer
+	services := []Service{testService("a", "running")}
+	var fulls []int
+	for i := 0; i < 3*(fullAnnounceEvery+1); i++ {
+		if a.next("peer", services, time.Now()).full() {
+			fulls = append(fulls, i)
+		}
+	}
+	want := []int{0, fullAnnounceEvery + 1, 2 * (fullAnnounceEvery + 1)}
+	if !reflect.DeepEqual(fulls, want) {
+		t.Errorf("full announcements at %v, want %v", fulls, want)
+	}
+}
+
+func TestPeerViewIgnoresStale(t *testing.T) {
+	var a announcer
+	var v peerView
+	now := time.Now()
+
+	first := a.next("peer", []Service{testService("a", "running")}, now)
+	second := a.next("peer", []Service{testService("a", "exited")}, now)
+	deliver(t, &v, second)
+	deliver(t, &v, first)
+	if v.services[0].Status != "exited" {
+		t.Errorf("older message overwrote newer one")
+	}
+}
+
+// A receiver that misses a delta notices, asks for a resync through its
+// own next message, and the sender's full announcement repairs its view.
+func TestPeerViewGapResync(t *testing.T) {
+	var sender, receiver announcer
+	var v peerView
+	now := time.Now()
+
+	deliver(t, &v, sender.next("peer", []Service{testService("a", "running"), testService("b", "running")}, now))
+
+	// Lost: b is withdrawn.
+	sender.next("peer", []Service{testService("a", "running")}, now)
+
+	hb := sender.next("peer", []Service{testService("a", "running")}, now)
+	if !deliver(t, &v, hb) {
+		t.Fatal("heartbeat ahead of the view not reported as a gap")
+	}
+	if got := serviceIDs(v.services); len(got) != 2 {
+		t.Fatalf("heartbeat changed the view: %v", got)
+	}
+
+	receiver.resync = true
+	ask, err := unmarshalWire(receiver.next("other", nil, now).marshal())
+	if err != nil || !ask.Resync {
+		t.Fatalf("resync not sent: %+v, %v", ask, err)
+	}
+	if receiver.next("other", nil, now).Resync {
+		t.Error("resync sent twice")
+	}
+
+	sender.wantFull = true
+	full := sender.next("peer", []Service{testService("a", "running")}, now)
+	if !full.full() {
+		t.Fatal("wantFull did not produce a full announcement")
+	}
+	if deliver(t, &v, full) {
+		t.Error("full announcement reported as a gap")
+	}
+	if got := serviceIDs(v.services); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("view after resync: %v", got)
+	}
+}
+
+func TestPeerViewDeltaGap(t *testing.T) {
+	var a announcer
+	var v peerView
+	now := time.Now()
+
+	deliver(t, &v, a.next("peer", []Service{testService("a", "running")}, now))
+	a.next("peer", []Service{testService("a", "exited")}, now) // lost
+	m := a.next("peer", []Service{testService("a", "exited"), testService("b", "running")}, now)
+	if !deliver(t, &v, m) {
+		t.Error("delta on a missed base not reported as a gap")
+	}
+	if got := serviceIDs(v.services); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("delta not applied after gap: %v", got)
+	}
+
+	// A view that starts mid-stream is a gap too.
+	var late peerView
+	if !deliver(t, &late, a.next("peer", []Service{testService("c", "running")}, now)) {
+		t.Error("first message a delta, no gap reported")
+	}
+}
+
+func TestAnnouncerGoodbyeCloses(t *testing.T) {
+	var a announcer
+	now := time.Now()
+	a.next("peer", []Service{testService("a", "running")}, now)
+
+	m, ok := a.withdraw("peer", nil, true, now)
+	if !ok || !m.Goodbye || !reflect.DeepEqual(m.Withdrawn, []string{"a"}) {
+		t.Fatalf("goodbye: %+v, %v", m, ok)
+	}
+	if !a.closed {
+		t.Error("announcer still open after goodbye")
+	}
+	if _, ok := a.withdraw("peer", nil, true, now); ok {
+		t.Error("second goodbye sent")
+	}
+
+	var quiet announcer
+	quiet.withdraw("peer", nil, true, now)
+	if !quiet.closed {
+		t.Error("goodbye before any announcement left the announcer open")
+	}
+}